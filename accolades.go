@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/* PvP titles, mounts and achievements making up a player's accolades across seasons */
+
+const defaultPvPMountKeywords string = "Gladiator,Vicious"
+
+var pvpMountKeywords []string = parseKeywords(getEnvVarStringOrDefault("PVP_MOUNT_KEYWORDS", defaultPvPMountKeywords))
+
+// Achievements awarding each title, fetched once per run as players share most titles
+var titleAchievements sync.Map
+
+// Accolade kinds
+const (
+	accoladeAchievement string = "ACHIEVEMENT"
+	accoladeTitle       string = "TITLE"
+	accoladeMount       string = "MOUNT"
+)
+
+// Parses comma separated keywords skipping empty entries
+func parseKeywords(keywords string) []string {
+	parsed := make([]string, 0)
+	for _, k := range strings.Split(keywords, ",") {
+		keyword := strings.TrimSpace(k)
+		if keyword != "" {
+			parsed = append(parsed, keyword)
+		}
+	}
+	return parsed
+}
+
+func containsKeyword(name string, keywords []string) bool {
+	for _, keyword := range keywords {
+		if strings.Contains(name, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Titles and mounts for which isPvP is true, neither has a
+// completion time so they're timestamped when first seen
+func filterAccolades(kind string, owned []keyedValue, isPvP func(keyedValue) bool) []accolade {
+	accolades := make([]accolade, 0)
+	for _, o := range owned {
+		if o.ID > 0 && isPvP(o) {
+			accolades = append(accolades, accolade{kind, o.ID, o.Name, 0})
+		}
+	}
+	return accolades
+}
+
+func getPlayerAccolades(path string, achievements []playerAchievement, pvpAchievements map[int]bool) []accolade {
+	accolades := make([]accolade, 0, len(achievements))
+	for _, achievement := range achievements {
+		accolades = append(accolades, accolade{accoladeAchievement, achievement.ID, "", achievement.CompletedAt})
+	}
+	accolades = append(accolades, getPlayerTitles(path, pvpAchievements)...)
+	accolades = append(accolades, getPlayerMounts(path)...)
+	return accolades
+}
+
+// PvP titles are those awarded by an achievement of the PvP achievement catalog
+func getPlayerTitles(path string, pvpAchievements map[int]bool) []accolade {
+	type TitlesJSON struct {
+		Titles []keyedValue
+	}
+	var titlesJSON *[]byte = getProfile(region, path+"/titles")
+	if titlesJSON == nil {
+		return []accolade{}
+	}
+	var titles TitlesJSON
+	err := safeUnmarshal(titlesJSON, &titles)
+	if err != nil {
+		logger.Printf("%s parsing titles failed: %s", warnPrefix, err)
+		return []accolade{}
+	}
+	return filterAccolades(accoladeTitle, titles.Titles, func(title keyedValue) bool {
+		for _, id := range getTitleAchievements(title.ID) {
+			if pvpAchievements[id] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func getTitleAchievements(id int) []int {
+	if cached, exists := titleAchievements.Load(id); exists {
+		return cached.([]int)
+	}
+	var titleJSON *[]byte = getStatic(region, fmt.Sprintf("title/%d", id))
+	if titleJSON == nil {
+		return []int{}
+	}
+	achievementIDs := parseTitleAchievements(titleJSON)
+	titleAchievements.Store(id, achievementIDs)
+	return achievementIDs
+}
+
+// IDs of the achievements a title is the reward of
+func parseTitleAchievements(data *[]byte) []int {
+	type SourceJSON struct {
+		Achievements []keyedValue
+	}
+	type TitleJSON struct {
+		Source SourceJSON
+	}
+	var title TitleJSON
+	err := safeUnmarshal(data, &title)
+	if err != nil {
+		logger.Printf("%s parsing title failed: %s", warnPrefix, err)
+		return []int{}
+	}
+	achievementIDs := make([]int, 0, len(title.Source.Achievements))
+	for _, achievement := range title.Source.Achievements {
+		achievementIDs = append(achievementIDs, achievement.ID)
+	}
+	return achievementIDs
+}
+
+func getPlayerMounts(path string) []accolade {
+	type CollectedMountJSON struct {
+		Mount keyedValue
+	}
+	type MountsJSON struct {
+		Mounts []CollectedMountJSON
+	}
+	var mountsJSON *[]byte = getProfile(region, path+"/collections/mounts")
+	if mountsJSON == nil {
+		return []accolade{}
+	}
+	var mounts MountsJSON
+	err := safeUnmarshal(mountsJSON, &mounts)
+	if err != nil {
+		logger.Printf("%s parsing mounts failed: %s", warnPrefix, err)
+		return []accolade{}
+	}
+	owned := make([]keyedValue, 0, len(mounts.Mounts))
+	for _, m := range mounts.Mounts {
+		owned = append(owned, m.Mount)
+	}
+	return filterAccolades(accoladeMount, owned, func(mount keyedValue) bool {
+		return containsKeyword(mount.Name, pvpMountKeywords)
+	})
+}
+
+// Store the start (and end) of every PvP season so accolades can be attributed to one
+func importPvPSeasons() {
+	type SeasonsJSON struct {
+		Seasons []keyedValue
+	}
+	var seasonsJSON *[]byte = getDynamic(region, "pvp-season/index")
+	var seasons SeasonsJSON
+	err := safeUnmarshal(seasonsJSON, &seasons)
+	if err != nil {
+		logger.Printf("%s parsing seasons failed: %s", warnPrefix, err)
+		return
+	}
+
+	ids := make([]int, 0, len(seasons.Seasons))
+	for _, s := range seasons.Seasons {
+		ids = append(ids, s.ID)
+	}
+	pvpSeasons := make([]pvpSeason, 0, len(ids))
+	var mutex sync.Mutex
+	fetchAll(ids, func(id int) {
+		type SeasonJSON struct {
+			ID    int
+			Start int64 `json:"season_start_timestamp"`
+			End   int64 `json:"season_end_timestamp"`
+		}
+		var seasonJSON *[]byte = getDynamic(region, fmt.Sprintf("pvp-season/%d", id))
+		var s SeasonJSON
+		if safeUnmarshal(seasonJSON, &s) != nil || s.Start == 0 {
+			return
+		}
+		mutex.Lock()
+		pvpSeasons = append(pvpSeasons, pvpSeason{s.ID, s.Start, s.End})
+		mutex.Unlock()
+	})
+	logger.Printf("Found %d PvP seasons", len(pvpSeasons))
+	addPvPSeasons(&pvpSeasons)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* Catalog of the PvP achievements to import and how to tag them */
+
+// Seasonal achievements are found by name within the PvP Feats of Strength category
+const defaultAchievementCatalog string = `{
+	"categories": [
+		{"id": 15270, "name_contains": "Season", "tags": {"seasonal": true}}
+	],
+	"achievements": [
+		{"ids": [399, 400, 401, 1159], "tags": {"bracket": "2v2"}},
+		{"ids": [402, 403, 405, 1160, 5266, 5267, 2091], "tags": {"bracket": "3v3"}},
+		{"ids": [5341, 5355, 5343, 5356, 6942, 6941], "tags": {"bracket": "rbg"}}
+	]
+}`
+
+var pvpAchievementCatalog achievementCatalog = loadAchievementCatalog(os.Getenv("ACHIEVEMENT_CATALOG_FILE"))
+
+// achievementCatalog : categories to search and explicit achievements to import
+type achievementCatalog struct {
+	Categories   []catalogCategory    `json:"categories"`
+	Achievements []catalogAchievement `json:"achievements"`
+}
+
+// catalogCategory : an achievement category, optionally filtered by name and including its subcategories
+type catalogCategory struct {
+	ID            int             `json:"id"`
+	NameContains  string          `json:"name_contains"`
+	Subcategories bool            `json:"subcategories"`
+	Tags          achievementTags `json:"tags"`
+}
+
+// catalogAchievement : explicit achievement IDs sharing the same tags
+type catalogAchievement struct {
+	IDs  []int           `json:"ids"`
+	Tags achievementTags `json:"tags"`
+}
+
+// achievementTags : what an achievement is for
+type achievementTags struct {
+	Bracket  string `json:"bracket"`
+	Tier     string `json:"tier"`
+	Seasonal bool   `json:"seasonal"`
+}
+
+func loadAchievementCatalog(file string) achievementCatalog {
+	data := []byte(defaultAchievementCatalog)
+	if file != "" {
+		fileData, err := os.ReadFile(file)
+		if err != nil {
+			logger.Printf("%s reading achievement catalog failed, using default: %s", warnPrefix, err)
+		} else {
+			data = fileData
+		}
+	}
+	catalog, err := parseAchievementCatalog(data)
+	if err != nil {
+		logger.Printf("%s parsing achievement catalog failed, using default: %s", warnPrefix, err)
+		catalog, _ = parseAchievementCatalog([]byte(defaultAchievementCatalog))
+	}
+	return catalog
+}
+
+func parseAchievementCatalog(data []byte) (achievementCatalog, error) {
+	var catalog achievementCatalog
+	err := json.Unmarshal(data, &catalog)
+	return catalog, err
+}
+
+// IDs of achievements in a category (whose names contain nameContains) and its subcategories
+func parseAchievementCategory(data *[]byte, nameContains string) ([]int, []int) {
+	type CategoryJSON struct {
+		Achievements  []keyedValue
+		Subcategories []keyedValue
+	}
+	var category CategoryJSON
+	err := safeUnmarshal(data, &category)
+	if err != nil {
+		logger.Printf("%s parsing achievement category failed: %s", warnPrefix, err)
+		return []int{}, []int{}
+	}
+
+	achievementIDs := make([]int, 0)
+	for _, ac := range category.Achievements {
+		if strings.Contains(ac.Name, nameContains) {
+			achievementIDs = append(achievementIDs, ac.ID)
+		}
+	}
+	subcategoryIDs := make([]int, 0, len(category.Subcategories))
+	for _, sub := range category.Subcategories {
+		subcategoryIDs = append(subcategoryIDs, sub.ID)
+	}
+	return achievementIDs, subcategoryIDs
+}
+
+// Every achievement in the catalog with its tags, explicit IDs take precedence over categories
+func getCatalogAchievements(catalog achievementCatalog) map[int]achievementTags {
+	tagged := make(map[int]achievementTags)
+	visited := make(map[int]bool)
+	for _, category := range catalog.Categories {
+		pending := []int{category.ID}
+		for len(pending) > 0 {
+			id := pending[0]
+			pending = pending[1:]
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+			var categoryJSON *[]byte = getStatic(region, fmt.Sprintf("achievement-category/%d", id))
+			achievementIDs, subcategoryIDs := parseAchievementCategory(categoryJSON, category.NameContains)
+			for _, achievementID := range achievementIDs {
+				tagged[achievementID] = category.Tags
+			}
+			if category.Subcategories {
+				pending = append(pending, subcategoryIDs...)
+			}
+		}
+	}
+	for _, explicit := range catalog.Achievements {
+		for _, id := range explicit.IDs {
+			tagged[id] = explicit.Tags
+		}
+	}
+	return tagged
+}
+
+func importAchievements() []achievement {
+	known := getAchievementIds()
+	tagged := getCatalogAchievements(pvpAchievementCatalog)
+	ids := make([]int, 0, len(tagged))
+	for id := range tagged {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	achievements := make([]achievement, 0, len(ids))
+	var mutex sync.Mutex
+	fetchAll(ids, func(id int) {
+		achievement := getAchievement(id)
+		achievement.Tags = tagged[id]
+		mutex.Lock()
+		achievements = append(achievements, achievement)
+		mutex.Unlock()
+	})
+	logger.Printf("Found %d PvP achievements", len(achievements))
+	addAchievements(&achievements)
+
+	return newAchievements(achievements, known)
+}
+
+// Achievements not previously known (none are new when nothing was known)
+func newAchievements(achievements []achievement, known map[int]bool) []achievement {
+	added := make([]achievement, 0)
+	if len(known) == 0 {
+		return added
+	}
+	for _, achievement := range achievements {
+		if !known[achievement.ID] {
+			added = append(added, achievement)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].ID < added[j].ID
+	})
+	return added
+}
+
+func reportNewAchievements(added []achievement) {
+	if len(added) == 0 {
+		return
+	}
+	logger.Printf("Found %d new PvP achievements:", len(added))
+	for _, achievement := range added {
+		logger.Printf("  %d %s (%s)", achievement.ID, achievement.Title, achievement.Description)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Summaries computed from each run's data so the site needn't */
+
+const defaultRatingBands string = "0,1800,2100,2400"
+
+var ratingBands []int = parseRatingBands(getEnvVarStringOrDefault("RATING_BANDS", defaultRatingBands))
+
+// Approximates rank one titles as the top fraction ($3) of each bracket's leaderboard
+var r1Fraction float64 = float64(max(getEnvVarOrDefault("R1_PER_MILLE", 1), 1)) / 1000
+
+// Leaderboard entries of the region ($1) with their rating band: R1 for the top $3 of
+// the bracket, otherwise the lower bound of the highest threshold in $2 they meet
+// (NULL for entries below all thresholds).
+const bandedEntriesSQL string = `SELECT l.region, l.bracket, l.player_id, l.rating, p.spec_id,
+		CASE WHEN l.ranking <= GREATEST(1, FLOOR(COUNT(*) OVER (PARTITION BY l.bracket) * $3::FLOAT)) THEN 'R1'
+			ELSE (SELECT MAX(b) FROM UNNEST($2::INT[]) b WHERE b <= l.rating)::TEXT END AS rating_band
+		FROM leaderboards l JOIN players p ON p.id=l.player_id WHERE l.region=$1`
+
+// Combines the per spec solo shuffle and blitz brackets
+const bracketFamilySQL string = `CASE WHEN %[1]s LIKE 'solo\_%%' THEN 'shuffle'
+		WHEN %[1]s LIKE 'blitz\_%%' THEN 'blitz' ELSE %[1]s END`
+
+func bracketFamily(column string) string {
+	return fmt.Sprintf(bracketFamilySQL, column)
+}
+
+// Parses ascending rating thresholds in the form "0,1800,2100"
+func parseRatingBands(bands string) []int {
+	parsed := make([]int, 0)
+	for _, b := range strings.Split(bands, ",") {
+		band, err := strconv.Atoi(strings.TrimSpace(b))
+		if err != nil {
+			logger.Printf("%s Invalid rating band '%s'", warnPrefix, b)
+			continue
+		}
+		parsed = append(parsed, band)
+	}
+	sort.Ints(parsed)
+	return parsed
+}
+
+// Aggregates of the current region where brackets are those on this run's leaderboards
+func updateAggregates(brackets []string) {
+	updateItemPopularity()
+	updatePopularBuilds()
+	updateGuildRankings(brackets)
+	updateCompositionStats()
+	updateRepresentation()
+	updateStatDistributions()
+}
+
+// Popularity of items per slot, item sets and embellishments for
+// each spec in each bracket and rating band of the current region
+func updateItemPopularity() {
+	const itemQuery string = `INSERT INTO spec_item_popularity
+		(region, bracket, spec_id, rating_band, slot, item_id, players, percentage)
+		WITH entries AS (` + bandedEntriesSQL + `),
+		totals AS (SELECT bracket, spec_id, rating_band, COUNT(*) AS total FROM entries
+			WHERE rating_band IS NOT NULL GROUP BY bracket, spec_id, rating_band)
+		SELECT $1, e.bracket, e.spec_id, e.rating_band, REGEXP_REPLACE(pe.slot, '_[12]$', '') AS slot,
+			pe.item_id, COUNT(DISTINCT e.player_id), ROUND(100.0 * COUNT(DISTINCT e.player_id) / t.total, 2)
+		FROM entries e
+		JOIN players_equipment pe ON pe.player_id=e.player_id
+		JOIN totals t ON t.bracket=e.bracket AND t.spec_id=e.spec_id AND t.rating_band=e.rating_band
+		GROUP BY e.bracket, e.spec_id, e.rating_band, REGEXP_REPLACE(pe.slot, '_[12]$', ''), pe.item_id, t.total`
+	const setQuery string = `INSERT INTO spec_set_popularity
+		(region, bracket, spec_id, rating_band, set_id, pieces, players, percentage)
+		WITH entries AS (` + bandedEntriesSQL + `),
+		totals AS (SELECT bracket, spec_id, rating_band, COUNT(*) AS total FROM entries
+			WHERE rating_band IS NOT NULL GROUP BY bracket, spec_id, rating_band),
+		pieces AS (SELECT player_id, set_id, COUNT(*) AS pieces FROM players_equipment
+			WHERE set_id > 0 GROUP BY player_id, set_id)
+		SELECT $1, e.bracket, e.spec_id, e.rating_band, s.set_id, s.pieces,
+			COUNT(*), ROUND(100.0 * COUNT(*) / t.total, 2)
+		FROM entries e
+		JOIN pieces s ON s.player_id=e.player_id
+		JOIN totals t ON t.bracket=e.bracket AND t.spec_id=e.spec_id AND t.rating_band=e.rating_band
+		GROUP BY e.bracket, e.spec_id, e.rating_band, s.set_id, s.pieces, t.total`
+	const embellishmentQuery string = `INSERT INTO spec_embellishment_popularity
+		(region, bracket, spec_id, rating_band, item_id, players, percentage)
+		WITH entries AS (` + bandedEntriesSQL + `),
+		totals AS (SELECT bracket, spec_id, rating_band, COUNT(*) AS total FROM entries
+			WHERE rating_band IS NOT NULL GROUP BY bracket, spec_id, rating_band)
+		SELECT $1, e.bracket, e.spec_id, e.rating_band, pe.item_id,
+			COUNT(DISTINCT e.player_id), ROUND(100.0 * COUNT(DISTINCT e.player_id) / t.total, 2)
+		FROM entries e
+		JOIN players_equipment pe ON pe.player_id=e.player_id AND pe.embellished
+		JOIN totals t ON t.bracket=e.bracket AND t.spec_id=e.spec_id AND t.rating_band=e.rating_band
+		GROUP BY e.bracket, e.spec_id, e.rating_band, pe.item_id, t.total`
+
+	args := [][]interface{}{{region, ratingBands, r1Fraction}}
+	deleteArgs := []interface{}{region}
+
+	numInserted := insert(query{SQL: itemQuery, Args: args,
+		Before: "DELETE FROM spec_item_popularity WHERE region=$1", BeforeArgs: deleteArgs})
+	logger.Printf("Set %d %s spec item popularity rows", numInserted, region)
+
+	numInserted = insert(query{SQL: setQuery, Args: args,
+		Before: "DELETE FROM spec_set_popularity WHERE region=$1", BeforeArgs: deleteArgs})
+	logger.Printf("Set %d %s spec item set popularity rows", numInserted, region)
+
+	numInserted = insert(query{SQL: embellishmentQuery, Args: args,
+		Before: "DELETE FROM spec_embellishment_popularity WHERE region=$1", BeforeArgs: deleteArgs})
+	logger.Printf("Set %d %s spec embellishment popularity rows", numInserted, region)
+}
+
+// Talents of every player on the region's leaderboards (a player
+// on multiple leaderboards will have a build for each bracket)
+func getLeaderboardBuilds() []playerBuild {
+	type buildKey struct {
+		Bracket  string
+		PlayerID int
+	}
+	builds := make(map[buildKey]*playerBuild)
+	rows, err := db.Query(`SELECT l.bracket, l.player_id, l.rating, p.spec_id, COALESCE(h.hero_tree_id, 0),
+		pt.talent_id, t.node_id, pt.rank FROM leaderboards l
+		JOIN players p ON p.id=l.player_id
+		JOIN players_talents pt ON pt.player_id=l.player_id AND NOT pt.stale
+		JOIN talents t ON t.id=pt.talent_id
+		LEFT JOIN players_hero_trees h ON h.player_id=l.player_id
+		WHERE l.region=$1`, region)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return []playerBuild{}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bracket string
+		var playerID, rating, specID, heroTreeID, talentID, nodeID, rank int
+		err := rows.Scan(&bracket, &playerID, &rating, &specID, &heroTreeID, &talentID, &nodeID, &rank)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+			continue
+		}
+		key := buildKey{bracket, playerID}
+		build, exists := builds[key]
+		if !exists {
+			build = &playerBuild{bracket, specID, heroTreeID, rating, make(map[int]selectedTalent)}
+			builds[key] = build
+		}
+		build.Talents[nodeID] = selectedTalent{talentID, nodeID, rank}
+	}
+
+	b := make([]playerBuild, 0, len(builds))
+	for _, build := range builds {
+		b = append(b, *build)
+	}
+	return b
+}
+
+func addPopularBuilds(args [][]interface{}) {
+	const qry string = `INSERT INTO popular_builds (region, bracket, spec_id, hero_tree_id, ranking,
+		signature, talent_ids, talent_ranks, players, cluster_players, sample_size, avg_rating)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	numInserted := insert(query{SQL: qry, Args: args,
+		Before: "DELETE FROM popular_builds WHERE region=$1", BeforeArgs: []interface{}{region}})
+	logger.Printf("Set %d %s popular builds", numInserted, region)
+}
+
+// Ranked members, best and average (of each member's best) rating of guilds per
+// bracket with the per spec solo shuffle and blitz brackets combined. Only members
+// on the given brackets count so guilds whose members are no longer ranked (e.g.
+// on a bracket absent from this run) lose their rankings
+func updateGuildRankings(brackets []string) {
+	var qry string = `INSERT INTO guild_rankings (region, bracket, guild_id, members, best_rating, avg_rating)
+		WITH entries AS (SELECT ` + bracketFamily("l.bracket") + ` AS bracket,
+				p.guild_id, p.id AS player_id, MAX(l.rating) AS rating
+			FROM leaderboards l JOIN players p ON p.id=l.player_id
+			WHERE l.region=$1 AND l.bracket = ANY($2) AND p.guild_id IS NOT NULL
+			GROUP BY 1, p.guild_id, p.id)
+		SELECT $1, bracket, guild_id, COUNT(*), MAX(rating), ROUND(AVG(rating), 2)
+		FROM entries GROUP BY bracket, guild_id`
+
+	numInserted := insert(query{SQL: qry, Args: [][]interface{}{{region, brackets}},
+		Before: "DELETE FROM guild_rankings WHERE region=$1", BeforeArgs: []interface{}{region}})
+	logger.Printf("Set %d %s guild rankings", numInserted, region)
+}
+
+// Representation and ratings of each spec composition among the region's inferred teams
+func updateCompositionStats() {
+	const qry string = `INSERT INTO composition_stats
+		(region, bracket, spec_ids, teams, percentage, avg_rating, max_rating, avg_confidence)
+		WITH compositions AS (SELECT t.bracket, t.rating, t.confidence,
+				ARRAY(SELECT p.spec_id FROM players p WHERE p.id = ANY(t.player_ids) ORDER BY p.spec_id) AS spec_ids
+			FROM inferred_teams t WHERE t.region=$1)
+		SELECT $1, bracket, spec_ids, COUNT(*), ROUND(100.0 * COUNT(*) / SUM(COUNT(*)) OVER (PARTITION BY bracket), 2),
+			ROUND(AVG(rating), 2), MAX(rating), ROUND(AVG(confidence), 3)
+		FROM compositions GROUP BY bracket, spec_ids`
+
+	numInserted := insert(query{SQL: qry, Args: [][]interface{}{{region}},
+		Before: "DELETE FROM composition_stats WHERE region=$1", BeforeArgs: []interface{}{region}})
+	logger.Printf("Set %d %s composition stats", numInserted, region)
+}
+
+// Counts and percentages of each spec, race, faction and hero tree per bracket and
+// rating band (and across all bands) of the current region, kept for each run
+func updateRepresentation() {
+	var qry string = `INSERT INTO representation_history
+		(run_at, region, bracket, rating_band, dimension, value_id, players, percentage)
+		WITH entries AS (` + bandedEntriesSQL + `),
+		banded AS (SELECT ` + bracketFamily("bracket") + ` AS bracket, player_id, rating_band
+			FROM entries WHERE rating_band IS NOT NULL
+			UNION ALL SELECT ` + bracketFamily("bracket") + `, player_id, 'all' FROM entries),
+		dimensions AS (SELECT e.bracket, e.rating_band, d.dimension, d.value_id FROM banded e
+			JOIN players p ON p.id=e.player_id
+			LEFT JOIN players_hero_trees h ON h.player_id=e.player_id
+			CROSS JOIN LATERAL (VALUES ('spec', p.spec_id), ('race', p.race_id),
+				('faction', p.faction_id), ('hero_tree', h.hero_tree_id)) d(dimension, value_id)
+			WHERE d.value_id IS NOT NULL)
+		SELECT TO_TIMESTAMP($4), $1, bracket, rating_band, dimension, value_id, COUNT(*),
+			ROUND(100.0 * COUNT(*) / SUM(COUNT(*)) OVER (PARTITION BY bracket, rating_band, dimension), 2)
+		FROM dimensions GROUP BY bracket, rating_band, dimension, value_id`
+
+	// Resumed runs replace the region's rows for the run rather than duplicating them
+	runStart := getImportRunStart()
+	numInserted := insert(query{SQL: qry, Args: [][]interface{}{{region, ratingBands, r1Fraction, runStart}},
+		Before:     "DELETE FROM representation_history WHERE region=$1 AND run_at=TO_TIMESTAMP($2)",
+		BeforeArgs: []interface{}{region, runStart}})
+	logger.Printf("Set %d %s representation rows", numInserted, region)
+}
+
+// Secondary stats of each player per bracket (with the per spec solo shuffle and blitz
+// brackets combined) of the current region, using their best rating in the bracket
+func getStatSamples() []statSample {
+	samples := make([]statSample, 0)
+	var qry string = `SELECT ` + bracketFamily("l.bracket") + ` AS bracket, p.spec_id, MAX(l.rating),
+		s.critical_strike, s.haste, s.mastery, s.versatility, s.leech
+		FROM leaderboards l JOIN players p ON p.id=l.player_id JOIN players_stats s ON s.player_id=p.id
+		WHERE l.region=$1 GROUP BY 1, p.id, p.spec_id, s.critical_strike, s.haste, s.mastery, s.versatility, s.leech`
+	rows, err := db.Query(qry, region)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return samples
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sample statSample
+		var crit, haste, mastery, versatility, leech float64
+		err := rows.Scan(&sample.Bracket, &sample.SpecID, &sample.Rating, &crit, &haste, &mastery, &versatility, &leech)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+			continue
+		}
+		sample.Values = []float64{crit, haste, mastery, versatility, leech}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func addStatDistributions(args [][]interface{}) {
+	const qry string = `INSERT INTO stat_distributions (region, bracket, spec_id, stat, players,
+		mean, median, p10, p25, p75, p90, rating_weighted)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	numInserted := insert(query{SQL: qry, Args: args,
+		Before: "DELETE FROM stat_distributions WHERE region=$1", BeforeArgs: []interface{}{region}})
+	logger.Printf("Set %d %s stat distributions", numInserted, region)
+}
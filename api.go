@@ -9,34 +9,67 @@ import (
 	"time"
 )
 
-const baseURI string = "https://%s.api.blizzard.com/%s%s"
+const baseURI string = "https://%s/%s%s"
+const defaultHost string = "%s.api.blizzard.com"
 const oauthURI string = "https://us.battle.net/oauth/token"
-const requiredParams string = "?locale=en_US&namespace=%s"
+const requiredParams string = "?locale=%s&namespace=%s"
+const allLocalesParams string = "?namespace=%s"
+const defaultLocale string = "en_US"
 const rateLimitRetryWaitSeconds int = 2
 const maxRetryAttempts = 2
+const defaultRequestsPerSecond int = 90
+
+// Locale used for the names of each region's realms, falling back to the default. Everything
+// else is requested in the default locale so stored names compare equal across regions.
+var regionLocales map[string]string = parseRegionLocales(
+	getEnvVarStringOrDefault("REGION_LOCALES", "KR=ko_KR,TW=zh_TW"))
 
 var clienID string = getEnvVar("BATTLE_NET_CLIENT_ID")
 var secret string = getEnvVar("BATTLE_NET_SECRET")
 var token string = createToken()
 
+// All requests share a single limiter so adding workers never exceeds Blizzard's rate limit
+var rateLimiter *time.Ticker = time.NewTicker(time.Second /
+	time.Duration(max(getEnvVarOrDefault("API_REQUESTS_PER_SECOND", defaultRequestsPerSecond), 1)))
+
 func getStatic(region, path string) *[]byte {
 	var namespace = "static-" + region
 	var staticPath = "data/wow/" + path
 	return get(region, namespace, staticPath)
 }
 
+// Omitting the locale returns names and descriptions in every locale
+func getStaticAllLocales(region, path string) *[]byte {
+	var namespace = "static-" + region
+	var staticPath = "data/wow/" + path
+	return getWithLocale(region, namespace, staticPath, "")
+}
+
 func getDynamic(region, path string) *[]byte {
 	var namespace = "dynamic-" + region
 	var dynamicPath = "data/wow/" + path
 	return get(region, namespace, dynamicPath)
 }
 
+func getDynamicInRegionLocale(region, path string) *[]byte {
+	var namespace = "dynamic-" + region
+	var dynamicPath = "data/wow/" + path
+	return getWithLocale(region, namespace, dynamicPath, localeForRegion(region))
+}
+
 func getProfile(region, path string) *[]byte {
 	var namespace = "profile-" + region
 	var profilePath = "profile/wow/character/" + path
 	return get(region, namespace, profilePath)
 }
 
+// As getProfile but also returning the HTTP status (0 if no response was received)
+func getProfileWithStatus(region, path string) (*[]byte, int) {
+	var namespace = "profile-" + region
+	var profilePath = "profile/wow/character/" + path
+	return getWithStatus(region, namespace, profilePath, defaultLocale, true, 1)
+}
+
 func getMedia(region, path string) *[]byte {
 	var namespace = "static-" + region
 	var mediaPath = "data/wow/media/" + path
@@ -69,46 +102,103 @@ func getIcon(region, path string) string {
 	return ""
 }
 
+func parseRegionLocales(locales string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(locales, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), "=")
+		if len(parts) != 2 {
+			continue
+		}
+		m[strings.ToUpper(parts[0])] = parts[1]
+	}
+	return m
+}
+
+func localeForRegion(region string) string {
+	locale, exists := regionLocales[strings.ToUpper(region)]
+	if !exists {
+		return defaultLocale
+	}
+	return locale
+}
+
+func apiHost(region string) string {
+	return fmt.Sprintf(defaultHost, strings.ToLower(region))
+}
+
+// Icon of a media asset referenced by its full API href
+func getIconFromHref(region, href string) string {
+	start := strings.Index(href, "/media/")
+	if start < 0 {
+		return ""
+	}
+	path := href[start+len("/media/"):]
+	end := strings.Index(path, "?")
+	if end >= 0 {
+		path = path[:end]
+	}
+	return getIcon(region, path)
+}
+
 func get(region, namespace, path string) *[]byte {
-	return getWithRetry(region, namespace, path, 1)
+	return getWithRetry(region, namespace, path, defaultLocale, 1)
+}
+
+func getWithLocale(region, namespace, path, locale string) *[]byte {
+	return getWithRetry(region, namespace, path, locale, 1)
 }
 
-func getWithRetry(region, namespace, path string, attempt int) *[]byte {
-	var params string = fmt.Sprintf(requiredParams, strings.ToLower(namespace))
-	var url string = fmt.Sprintf(baseURI, strings.ToLower(region), path, params)
+func getWithRetry(region, namespace, path, locale string, attempt int) *[]byte {
+	body, _ := getWithStatus(region, namespace, path, locale, false, attempt)
+	return body
+}
+
+// Not found responses are only final (not retried) if finalNotFound is set, as for
+// profiles a missing character won't reappear within a run while other endpoints
+// can briefly return not found
+func getWithStatus(region, namespace, path, locale string, finalNotFound bool, attempt int) (*[]byte, int) {
+	var params string = fmt.Sprintf(requiredParams, locale, strings.ToLower(namespace))
+	if locale == "" {
+		params = fmt.Sprintf(allLocalesParams, strings.ToLower(namespace))
+	}
+	var url string = fmt.Sprintf(baseURI, apiHost(region), path, params)
 	var req, err = http.NewRequest("GET", url, nil)
 	if err != nil {
 		logger.Printf("%s Failed to create request for '%s': %s", errPrefix, path, err)
-		return nil
+		return nil, 0
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
+	<-rateLimiter.C
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		logger.Printf("%s GET '%s' failed: %s", errPrefix, path, err)
-		return nil
+		return nil, 0
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 429 {
 		time.Sleep(time.Duration(rateLimitRetryWaitSeconds) * time.Second)
-		return get(region, namespace, path)
+		return getWithStatus(region, namespace, path, locale, finalNotFound, 1)
+	}
+	if finalNotFound && resp.StatusCode == http.StatusNotFound {
+		return nil, resp.StatusCode
 	}
 	if resp.StatusCode != 200 {
 		if attempt > maxRetryAttempts {
-			return nil
+			return nil, resp.StatusCode
 		}
 		time.Sleep(time.Duration(rateLimitRetryWaitSeconds) * time.Second)
-		return getWithRetry(region, namespace, path, attempt+1)
+		return getWithStatus(region, namespace, path, locale, finalNotFound, attempt+1)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
 		logger.Printf("%s reading body of '%s' failed: %s", errPrefix, path, err)
-		return nil
+		return nil, resp.StatusCode
 	}
 
-	return &body
+	return &body, resp.StatusCode
 }
 
 func createToken() string {
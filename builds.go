@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var buildClusterDistance int = getEnvVarOrDefault("BUILD_CLUSTER_DISTANCE", 2)
+var popularBuildsPerGroup int = getEnvVarOrDefault("POPULAR_BUILDS_PER_GROUP", 10)
+
+// playerBuild : a leaderboard player's talents keyed by node ID
+type playerBuild struct {
+	Bracket    string
+	SpecID     int
+	HeroTreeID int
+	Rating     int
+	Talents    map[int]selectedTalent
+}
+
+// buildCluster : a build and the near-identical builds grouped with it
+type buildCluster struct {
+	Signature      string
+	Talents        map[int]selectedTalent
+	Players        int
+	ClusterPlayers int
+	AvgRating      float64
+}
+
+// Canonical identifier of a set of talents regardless of their order
+func buildSignature(talents map[int]selectedTalent) string {
+	sorted := sortedTalents(talents)
+	parts := make([]string, 0, len(sorted))
+	for _, talent := range sorted {
+		parts = append(parts, fmt.Sprintf("%d:%d", talent.ID, talent.Rank))
+	}
+	hash := sha256.Sum256([]byte(strings.Join(parts, ",")))
+	return fmt.Sprintf("%x", hash)
+}
+
+// Talents ordered by talent ID
+func sortedTalents(talents map[int]selectedTalent) []selectedTalent {
+	sorted := make([]selectedTalent, 0, len(talents))
+	for _, talent := range talents {
+		sorted = append(sorted, talent)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// Number of nodes selected in only one build or with a different
+// talent (choice) or rank, so swapping a choice node counts once
+func nodeDistance(a map[int]selectedTalent, b map[int]selectedTalent) int {
+	distance := 0
+	for nodeID, talent := range a {
+		if other, exists := b[nodeID]; !exists || other != talent {
+			distance++
+		}
+	}
+	for nodeID := range b {
+		if _, exists := a[nodeID]; !exists {
+			distance++
+		}
+	}
+	return distance
+}
+
+// Group identical builds, then fold each build into the most popular cluster
+// within maxDistance of it (if any). Clusters are ordered by popularity.
+func clusterBuilds(builds []playerBuild, maxDistance int) []buildCluster {
+	type distinctBuild struct {
+		signature   string
+		talents     map[int]selectedTalent
+		players     int
+		totalRating int
+	}
+	distinct := make(map[string]*distinctBuild)
+	for _, build := range builds {
+		signature := buildSignature(build.Talents)
+		d, exists := distinct[signature]
+		if !exists {
+			d = &distinctBuild{signature: signature, talents: build.Talents}
+			distinct[signature] = d
+		}
+		d.players++
+		d.totalRating += build.Rating
+	}
+
+	ordered := make([]*distinctBuild, 0, len(distinct))
+	for _, d := range distinct {
+		ordered = append(ordered, d)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].players == ordered[j].players {
+			return ordered[i].signature < ordered[j].signature
+		}
+		return ordered[i].players > ordered[j].players
+	})
+
+	clusters := make([]buildCluster, 0)
+	totalRatings := make([]int, 0)
+	for _, d := range ordered {
+		merged := false
+		for i := range clusters {
+			if nodeDistance(clusters[i].Talents, d.talents) <= maxDistance {
+				clusters[i].ClusterPlayers += d.players
+				totalRatings[i] += d.totalRating
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			clusters = append(clusters, buildCluster{
+				Signature:      d.signature,
+				Talents:        d.talents,
+				Players:        d.players,
+				ClusterPlayers: d.players})
+			totalRatings = append(totalRatings, d.totalRating)
+		}
+	}
+
+	for i := range clusters {
+		clusters[i].AvgRating = float64(totalRatings[i]) / float64(clusters[i].ClusterPlayers)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return clusters[i].ClusterPlayers > clusters[j].ClusterPlayers
+	})
+	return clusters
+}
+
+// Write the most popular builds for each bracket, spec and hero tree of the current region
+func updatePopularBuilds() {
+	type groupKey struct {
+		Bracket    string
+		SpecID     int
+		HeroTreeID int
+	}
+	groups := make(map[groupKey][]playerBuild)
+	for _, build := range getLeaderboardBuilds() {
+		key := groupKey{build.Bracket, build.SpecID, build.HeroTreeID}
+		groups[key] = append(groups[key], build)
+	}
+
+	args := make([][]interface{}, 0)
+	for key, builds := range groups {
+		clusters := clusterBuilds(builds, buildClusterDistance)
+		for i, cluster := range clusters {
+			if i >= popularBuildsPerGroup {
+				break
+			}
+			ids := make([]int, 0, len(cluster.Talents))
+			ranks := make([]int, 0, len(cluster.Talents))
+			for _, talent := range sortedTalents(cluster.Talents) {
+				ids = append(ids, talent.ID)
+				ranks = append(ranks, talent.Rank)
+			}
+			args = append(args, []interface{}{region, key.Bracket, key.SpecID, key.HeroTreeID, i + 1,
+				cluster.Signature, ids, ranks, cluster.Players, cluster.ClusterPlayers, len(builds),
+				cluster.AvgRating})
+		}
+	}
+	addPopularBuilds(args)
+}
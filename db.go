@@ -2,6 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +20,10 @@ var db *sql.DB = dbConnect()
 var lock sync.Mutex
 
 var realmSlugs = make(map[int]string)
+var realmSlugsLock sync.Mutex
+
+// Per region re-import of realms, run at most once per run due to an unknown realm
+var realmRefreshes = make(map[string]*sync.Once)
 
 func dbConnect() *sql.DB {
 	var dbURL string = getEnvVar("DB_URL")
@@ -102,6 +109,42 @@ func execute(sql string) {
 	}
 }
 
+// Number of entries in each of the region's stored leaderboards
+func getLeaderboardSizes() map[string]int {
+	var m map[string]int = make(map[string]int)
+	rows, err := db.Query("SELECT bracket, COUNT(*) FROM leaderboards WHERE region=$1 GROUP BY bracket", region)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return m
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bracket string
+		var size int
+		err := rows.Scan(&bracket, &size)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+			continue
+		}
+		m[bracket] = size
+	}
+	return m
+}
+
+func addRunValidation(checks []validationCheck, outcome string) {
+	const qry string = `INSERT INTO run_validations (run_at, region, check_name, bracket, value, threshold, passed, outcome)
+		VALUES (NOW(), $1, $2, $3, $4, $5, $6, $7)`
+	args := make([][]interface{}, 0)
+
+	for _, check := range checks {
+		args = append(args, []interface{}{region, check.Name, check.Bracket, check.Value, check.Limit,
+			check.Passed, outcome})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Recorded %d %s validation checks (%s)", numInserted, region, outcome)
+}
+
 func updateLeaderboard(bracket string, leaderboard []leaderboardEntry) {
 	if len(leaderboard) == 0 {
 		return
@@ -139,11 +182,64 @@ func updateLeaderboard(bracket string, leaderboard []leaderboardEntry) {
 	logger.Printf("%s %s leaderboard set with %d entries", region, bracket, numInserted)
 }
 
+// Season records of the region's bracket as stored by the previous run
+func getLeaderboardSnapshot(bracket string) map[string]snapshotEntry {
+	var m map[string]snapshotEntry = make(map[string]snapshotEntry)
+	rows, err := db.Query(`SELECT p.realm_id, p.blizzard_id, l.season_wins, l.season_losses,
+		COALESCE(EXTRACT(EPOCH FROM p.last_login)::BIGINT, 0)
+		FROM leaderboards l JOIN players p ON p.id=l.player_id WHERE l.region=$1 AND l.bracket=$2`, region, bracket)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return m
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realmID int
+		var blizzardID int
+		var entry snapshotEntry
+		err := rows.Scan(&realmID, &blizzardID, &entry.Wins, &entry.Losses, &entry.LastLogin)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+			continue
+		}
+		m[playerKey(realmID, blizzardID)] = entry
+	}
+	return m
+}
+
+func addInferredTeams(bracket string, teams []inferredTeam, playerIDs map[string]int) {
+	const deleteQuery string = `DELETE FROM inferred_teams WHERE region=$1 AND bracket=$2`
+	const qry string = `INSERT INTO inferred_teams (region, bracket, player_ids, wins, losses, rating, confidence)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := make([][]interface{}, 0)
+
+	for _, team := range teams {
+		ids := make([]int, 0, len(team.Members))
+		for _, key := range team.Members {
+			if id := playerIDs[key]; id > 0 {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) != len(team.Members) {
+			continue
+		}
+		sort.Ints(ids)
+		args = append(args, []interface{}{region, bracket, ids, team.Wins, team.Losses, team.Rating,
+			math.Round(team.Confidence*1000) / 1000})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args, Before: deleteQuery,
+		BeforeArgs: []interface{}{region, bracket}})
+	logger.Printf("%s %s inferred teams set with %d teams", region, bracket, numInserted)
+}
+
 func addPlayers(players []*player) {
 	const qry string = `INSERT INTO players (name, realm_id, blizzard_id, class_id, spec_id,
-		faction_id, race_id, gender, guild, last_login, profile_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, to_timestamp($10), $11)
+		faction_id, race_id, gender, guild, last_login, profile_id, guild_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, to_timestamp($10), $11,
+		(SELECT id FROM guilds WHERE realm_id=$12 AND blizzard_id=$13))
 		ON CONFLICT (realm_id, blizzard_id) DO UPDATE SET name=$1, spec_id=$5, faction_id=$6,
-		race_id=$7, gender=$8, guild=$9, last_login=to_timestamp($10), last_update=NOW(), profile_id=$11`
+		race_id=$7, gender=$8, guild=$9, last_login=to_timestamp($10), last_update=NOW(), profile_id=$11,
+		guild_id=EXCLUDED.guild_id`
 	args := make([][]interface{}, 0)
 
 	for _, player := range players {
@@ -152,7 +248,7 @@ func addPlayers(players []*player) {
 		}
 		params := []interface{}{player.Name, player.RealmID, player.BlizzardID, player.ClassID,
 			player.SpecID, player.FactionID, player.RaceID, player.Gender, player.Guild,
-			player.LastLogin, player.ProfileID}
+			player.LastLogin, player.ProfileID, player.GuildRealmID, player.GuildID}
 		args = append(args, params)
 	}
 
@@ -160,6 +256,27 @@ func addPlayers(players []*player) {
 	logger.Printf("Added or updated %d players", numInserted)
 }
 
+// Guilds are keyed by their realm and Blizzard ID as names are only unique per realm
+func addGuilds(players []*player) {
+	const qry string = `INSERT INTO guilds (realm_id, blizzard_id, name, faction_id)
+		SELECT $1, $2, $3, $4 WHERE EXISTS (SELECT 1 FROM realms WHERE id=$1)
+		ON CONFLICT (realm_id, blizzard_id) DO UPDATE SET name=$3, faction_id=$4, last_update=NOW()`
+	args := make([][]interface{}, 0)
+	added := make(map[string]bool)
+
+	for _, player := range players {
+		key := playerKey(player.GuildRealmID, player.GuildID)
+		if player.GuildID == 0 || added[key] {
+			continue
+		}
+		added[key] = true
+		args = append(args, []interface{}{player.GuildRealmID, player.GuildID, player.Guild, player.GuildFactionID})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Added or updated %d guilds", numInserted)
+}
+
 func getPlayerIDsFromLeaderboard(leaderboard []leaderboardEntry) map[string]int {
 	var m map[string]int = make(map[string]int)
 	rows, err := db.Query("SELECT id, realm_id, blizzard_id FROM players")
@@ -192,9 +309,21 @@ func getPlayerIDsFromLeaderboard(leaderboard []leaderboardEntry) map[string]int
 
 func getPlayerIDs(players []*player) map[string]int {
 	var m map[string]int = make(map[string]int)
-	rows, err := db.Query("SELECT id, realm_id, blizzard_id FROM players")
+	if len(players) == 0 {
+		return m
+	}
+	realmIDs := make([]int, 0, len(players))
+	blizzardIDs := make([]int, 0, len(players))
+	for _, player := range players {
+		realmIDs = append(realmIDs, player.RealmID)
+		blizzardIDs = append(blizzardIDs, player.BlizzardID)
+	}
+	// Only look up the given players as this is called once per DB batch
+	rows, err := db.Query(`SELECT id, realm_id, blizzard_id FROM players
+		WHERE (realm_id, blizzard_id) IN (SELECT * FROM UNNEST($1::INT[], $2::INT[]))`, realmIDs, blizzardIDs)
 	if err != nil {
 		logger.Printf("%s %s", errPrefix, err)
+		return m
 	}
 	defer rows.Close()
 	var t map[string]int = make(map[string]int)
@@ -220,6 +349,28 @@ func getPlayerIDs(players []*player) map[string]int {
 	return m
 }
 
+// Unix time each known player was last updated keyed by playerKey
+func getPlayersLastUpdate() map[string]int64 {
+	var m map[string]int64 = make(map[string]int64)
+	rows, err := db.Query("SELECT realm_id, blizzard_id, EXTRACT(EPOCH FROM last_update)::BIGINT FROM players")
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return m
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realmID int
+		var blizzardID int
+		var lastUpdate int64
+		err := rows.Scan(&realmID, &blizzardID, &lastUpdate)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+		}
+		m[playerKey(realmID, blizzardID)] = lastUpdate
+	}
+	return m
+}
+
 // Mark all existing player_talent and player_pvp_talent entries
 // as stale so we can delete any that aren't set to false after
 // all the addPlayerTalents calls have concluded.
@@ -230,23 +381,158 @@ func markStalePlayerTalents() {
 	execute(pvpTalentQuery)
 }
 
+// Returns the unix time an unfinished import run started at, or
+// zero if the previous run completed (or there never was one).
+func getImportRunStart() int64 {
+	var started int64 = 0
+	rows, err := db.Query("SELECT EXTRACT(EPOCH FROM last_update)::BIGINT FROM metadata WHERE key='import_run'")
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return started
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := rows.Scan(&started)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+		}
+	}
+	return started
+}
+
+// Begin a fresh import run: clear any checkpoints left behind by an
+// abandoned run and mark player talents stale. The run is only recorded
+// once talents are marked so an interruption before then starts over.
+func beginImportRun() {
+	execute("DELETE FROM import_checkpoints")
+	markStalePlayerTalents()
+	execute(`INSERT INTO metadata (key, last_update) VALUES ('import_run', NOW())
+		ON CONFLICT (key) DO UPDATE SET last_update=NOW()`)
+}
+
+// Finish the current import run so the next one starts from scratch.
+func completeImportRun() {
+	execute("DELETE FROM import_checkpoints")
+	execute("DELETE FROM metadata WHERE key='import_run'")
+}
+
+func getImportCheckpoints() map[string]bool {
+	var m map[string]bool = make(map[string]bool)
+	rows, err := db.Query("SELECT realm_id, blizzard_id FROM import_checkpoints")
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return m
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realmID int
+		var blizzardID int
+		err := rows.Scan(&realmID, &blizzardID)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+		}
+		m[playerKey(realmID, blizzardID)] = true
+	}
+	return m
+}
+
+func addImportCheckpoints(players []*player) {
+	const qry string = `INSERT INTO import_checkpoints (realm_id, blizzard_id, region)
+		VALUES ($1, $2, $3) ON CONFLICT (realm_id, blizzard_id) DO NOTHING`
+	args := make([][]interface{}, 0)
+
+	for _, player := range players {
+		args = append(args, []interface{}{player.RealmID, player.BlizzardID, region})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Checkpointed %d players", numInserted)
+}
+
+// Record each player's latest failure, counting consecutive not found runs and
+// starting a cooldown once the threshold is reached
+func addFetchFailures(failures map[*player]fetchFailure) {
+	if len(failures) == 0 {
+		return
+	}
+	const qry string = `INSERT INTO player_fetch_failures (realm_id, blizzard_id, region, endpoint, status,
+		failures, not_found_count, last_failed_at, cooldown_until)
+		VALUES ($1, $2, $3, $4, $5, 1, CASE WHEN $5=404 THEN 1 ELSE 0 END, NOW(),
+		CASE WHEN $5=404 AND 1 >= $6 THEN NOW() + MAKE_INTERVAL(hours => $7) END)
+		ON CONFLICT (realm_id, blizzard_id) DO UPDATE SET region=$3, endpoint=$4, status=$5,
+		failures=player_fetch_failures.failures + 1,
+		not_found_count=CASE WHEN $5=404 THEN player_fetch_failures.not_found_count + 1 ELSE 0 END,
+		last_failed_at=NOW(),
+		cooldown_until=CASE WHEN $5=404 AND player_fetch_failures.not_found_count + 1 >= $6
+			THEN NOW() + MAKE_INTERVAL(hours => $7) END`
+	args := make([][]interface{}, 0)
+
+	for player, failure := range failures {
+		args = append(args, []interface{}{player.RealmID, player.BlizzardID, region, failure.Endpoint,
+			failure.Status, notFoundCooldownThreshold, notFoundCooldownHours})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Recorded %d player fetch failures", numInserted)
+}
+
+// Players found again no longer count as failing
+func clearFetchFailures(players []*player) {
+	if len(players) == 0 {
+		return
+	}
+	const qry string = `DELETE FROM player_fetch_failures WHERE realm_id=$1 AND blizzard_id=$2`
+	args := make([][]interface{}, 0)
+
+	for _, player := range players {
+		args = append(args, []interface{}{player.RealmID, player.BlizzardID})
+	}
+
+	numDeleted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Cleared %d player fetch failures", numDeleted)
+}
+
+// Players of the current region not to be fetched until their cooldown ends
+func getPlayersInCooldown() map[string]bool {
+	var m map[string]bool = make(map[string]bool)
+	rows, err := db.Query(`SELECT realm_id, blizzard_id FROM player_fetch_failures
+		WHERE region=$1 AND cooldown_until > NOW()`, region)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return m
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realmID int
+		var blizzardID int
+		err := rows.Scan(&realmID, &blizzardID)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+			continue
+		}
+		m[playerKey(realmID, blizzardID)] = true
+	}
+	return m
+}
+
 func addPlayerTalents(playersTalents map[int]playerTalents) {
 	if len(playersTalents) == 0 {
 		return
 	}
-	const talentQuery string = `INSERT INTO players_talents (player_id, talent_id, stale)
-		SELECT $1, $2, FALSE WHERE EXISTS (SELECT 1 FROM talents WHERE id=$2) ON CONFLICT (player_id, talent_id) DO UPDATE SET stale=FALSE`
-	const pvpTalentQuery string = `INSERT INTO players_pvp_talents (player_id, pvp_talent_id, stale)
-		SELECT $1, $2, FALSE WHERE EXISTS (SELECT 1 FROM pvp_talents WHERE id=$2) ON CONFLICT (player_id, pvp_talent_id) DO UPDATE SET stale=FALSE`
+	const talentQuery string = `INSERT INTO players_talents (player_id, talent_id, rank, choice_index, stale)
+		SELECT $1, $2, $3, choice_index, FALSE FROM talents WHERE id=$2 ON CONFLICT (player_id, talent_id)
+		DO UPDATE SET rank=$3, choice_index=EXCLUDED.choice_index, stale=FALSE`
+	const pvpTalentQuery string = `INSERT INTO players_pvp_talents (player_id, pvp_talent_id, slot, stale)
+		SELECT $1, $2, $3, FALSE WHERE EXISTS (SELECT 1 FROM pvp_talents WHERE id=$2) ON CONFLICT (player_id, pvp_talent_id) DO UPDATE SET slot=$3, stale=FALSE`
 	talentArgs := make([][]interface{}, 0)
 	pvpTalentArgs := make([][]interface{}, 0)
 
 	for id, talents := range playersTalents {
 		for _, talent := range talents.Talents {
-			talentArgs = append(talentArgs, []interface{}{id, talent})
+			talentArgs = append(talentArgs, []interface{}{id, talent.ID, talent.Rank})
 		}
 		for _, pvptalent := range talents.PvPTalents {
-			pvpTalentArgs = append(pvpTalentArgs, []interface{}{id, pvptalent})
+			pvpTalentArgs = append(pvpTalentArgs, []interface{}{id, pvptalent.ID, pvptalent.Slot})
 		}
 	}
 
@@ -259,14 +545,55 @@ func addPlayerTalents(playersTalents map[int]playerTalents) {
 	logger.Printf("Mapped %d players=>PvP talents", numInserted)
 }
 
-func addPlayerAchievements(playerAchievements map[int][]int) {
-	const qry string = `INSERT INTO players_achievements (player_id, achievement_id) VALUES ($1, $2)
-		ON CONFLICT (player_id, achievement_id) DO NOTHING`
+func addPlayerHeroTrees(playersTalents map[int]playerTalents) {
+	const qry string = `INSERT INTO players_hero_trees (player_id, hero_tree_id, hero_tree_name)
+		VALUES ($1, $2, $3) ON CONFLICT (player_id) DO UPDATE SET hero_tree_id=$2, hero_tree_name=$3`
+	const deleteQuery string = `DELETE FROM players_hero_trees WHERE player_id = ANY($1)`
+	playerIDs := make([]int, 0)
+	args := make([][]interface{}, 0)
+
+	for id, talents := range playersTalents {
+		playerIDs = append(playerIDs, id)
+		if talents.HeroTree.ID == 0 {
+			continue
+		}
+		args = append(args, []interface{}{id, talents.HeroTree.ID, talents.HeroTree.Name})
+	}
+	if len(playerIDs) == 0 {
+		return
+	}
+
+	// Clear first so players who've since dropped their hero tree don't keep it
+	numInserted := insert(query{SQL: qry, Args: args, Before: deleteQuery, BeforeArgs: []interface{}{playerIDs}})
+	logger.Printf("Mapped %d players=>hero talent trees", numInserted)
+}
+
+func addPlayerLoadouts(playersLoadouts map[int]playerLoadout) {
+	const qry string = `INSERT INTO players_loadouts (player_id, loadout_code, valid)
+		VALUES ($1, $2, $3) ON CONFLICT (player_id) DO UPDATE SET loadout_code=$2, valid=$3`
+	args := make([][]interface{}, 0)
+	numValid := 0
+
+	for id, loadout := range playersLoadouts {
+		args = append(args, []interface{}{id, loadout.Code, loadout.Valid})
+		if loadout.Valid {
+			numValid++
+		}
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Mapped %d players=>loadouts (%d matching their talents)", numInserted, numValid)
+}
+
+func addPlayerAchievements(playerAchievements map[int][]playerAchievement) {
+	const qry string = `INSERT INTO players_achievements (player_id, achievement_id, completed_at)
+		VALUES ($1, $2, TO_TIMESTAMP($3::BIGINT / 1000.0))
+		ON CONFLICT (player_id, achievement_id) DO UPDATE SET completed_at = EXCLUDED.completed_at`
 	args := make([][]interface{}, 0)
 
 	for id, achievements := range playerAchievements {
-		for _, achievID := range achievements {
-			args = append(args, []interface{}{id, achievID})
+		for _, achievement := range achievements {
+			args = append(args, []interface{}{id, achievement.ID, achievement.CompletedAt})
 		}
 	}
 
@@ -275,6 +602,42 @@ func addPlayerAchievements(playerAchievements map[int][]int) {
 	logger.Printf("Mapped %d players=>achievements", numInserted)
 }
 
+// Accolades are never removed and keep the time they were first seen,
+// the season is that in which they were earned (or first seen)
+func addPlayerAccolades(playersAccolades map[int][]accolade) {
+	const qry string = `INSERT INTO players_accolades (player_id, kind, accolade_id, name, achieved_at, first_seen, season_id)
+		SELECT $1, $2, $3, $4, TO_TIMESTAMP(NULLIF($5::BIGINT, 0) / 1000.0), NOW(),
+		(SELECT MAX(id) FROM pvp_seasons WHERE start_time <= COALESCE(TO_TIMESTAMP(NULLIF($5::BIGINT, 0) / 1000.0), NOW()))
+		ON CONFLICT (player_id, kind, accolade_id) DO UPDATE SET achieved_at = EXCLUDED.achieved_at,
+		season_id = COALESCE(EXCLUDED.season_id, players_accolades.season_id)
+		WHERE EXCLUDED.achieved_at IS NOT NULL`
+	args := make([][]interface{}, 0)
+
+	for id, accolades := range playersAccolades {
+		for _, a := range accolades {
+			args = append(args, []interface{}{id, a.Kind, a.ID, a.Name, a.AchievedAt})
+		}
+	}
+
+	logger.Printf("Upserting up to %d players=>accolades", len(playersAccolades))
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Mapped %d players=>accolades", numInserted)
+}
+
+func addPvPSeasons(seasons *[]pvpSeason) {
+	const qry string = `INSERT INTO pvp_seasons (id, start_time, end_time)
+		VALUES ($1, TO_TIMESTAMP($2::BIGINT / 1000.0), TO_TIMESTAMP(NULLIF($3::BIGINT, 0) / 1000.0))
+		ON CONFLICT (id) DO UPDATE SET start_time = EXCLUDED.start_time, end_time = EXCLUDED.end_time`
+	args := make([][]interface{}, 0)
+
+	for _, season := range *seasons {
+		args = append(args, []interface{}{season.ID, season.Start, season.End})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Inserted or updated %d PvP seasons", numInserted)
+}
+
 func addPlayerStats(playersStats map[int]stats) {
 	const qry string = `INSERT INTO players_stats
 		(player_id, strength, agility, intellect, stamina, critical_strike, haste,
@@ -348,6 +711,85 @@ func addPlayerItems(playersItems *cmap.ConcurrentMap[string, items]) {
 	logger.Printf("Mapped %d players=>items", numInserted)
 }
 
+func addPlayerEquipment(playersItems *cmap.ConcurrentMap[string, items]) {
+	// Clear each player's equipment first so slots that are now empty don't linger
+	const deleteQuery string = `DELETE FROM players_equipment WHERE player_id = ANY($1)`
+	const qry string = `INSERT INTO players_equipment
+		(player_id, slot, item_id, item_level, enchant_ids, enchant_names, gem_ids,
+		bonus_ids, crafted_stats, set_id, embellished)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (player_id, slot) DO UPDATE SET item_id=$3, item_level=$4, enchant_ids=$5,
+		enchant_names=$6, gem_ids=$7, bonus_ids=$8, crafted_stats=$9, set_id=$10, embellished=$11`
+	const itemLevelQuery string = `UPDATE players SET average_item_level=$2 WHERE id=$1`
+	playerIDs := make([]int, 0)
+	args := make([][]interface{}, 0)
+	itemLevelArgs := make([][]interface{}, 0)
+
+	for tpl := range playersItems.Iter() {
+		id, _ := strconv.Atoi(tpl.Key)
+		equipment := tpl.Val.Equipment
+		if len(equipment) == 0 {
+			continue
+		}
+		playerIDs = append(playerIDs, id)
+		for _, e := range equipment {
+			args = append(args, []interface{}{id, e.Slot, e.ItemID, e.Level, e.EnchantIDs,
+				e.EnchantNames, e.GemIDs, e.BonusIDs, e.CraftedStats, e.SetID, e.Embellished})
+		}
+		itemLevelArgs = append(itemLevelArgs, []interface{}{id, averageItemLevel(equipment)})
+	}
+	if len(playerIDs) == 0 {
+		return
+	}
+
+	logger.Printf("Upserting equipment of %d players", len(playerIDs))
+	numInserted := insert(query{SQL: qry, Args: args, Before: deleteQuery, BeforeArgs: []interface{}{playerIDs}})
+	logger.Printf("Mapped %d players=>equipment", numInserted)
+	numUpdated := insert(query{SQL: itemLevelQuery, Args: itemLevelArgs})
+	logger.Printf("Set average item level of %d players", numUpdated)
+}
+
+// Previously fetched media keyed by player (realm and Blizzard ID)
+func getPlayersMedia() map[string]playerMedia {
+	var m map[string]playerMedia = make(map[string]playerMedia)
+	rows, err := db.Query(`SELECT p.realm_id, p.blizzard_id, pm.race_id, pm.gear_hash,
+		EXTRACT(EPOCH FROM pm.fetched_at)::BIGINT FROM players_media pm JOIN players p ON p.id=pm.player_id`)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return m
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realmID int
+		var blizzardID int
+		var media playerMedia
+		err := rows.Scan(&realmID, &blizzardID, &media.RaceID, &media.GearHash, &media.FetchedAt)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+			continue
+		}
+		m[playerKey(realmID, blizzardID)] = media
+	}
+	return m
+}
+
+func addPlayerMedia(playersMedia map[int]playerMedia) {
+	if len(playersMedia) == 0 {
+		return
+	}
+	const qry string = `INSERT INTO players_media (player_id, avatar, inset, main_raw, race_id, gear_hash, fetched_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW()) ON CONFLICT (player_id) DO UPDATE SET avatar = $2, inset = $3,
+		main_raw = $4, race_id = $5, gear_hash = $6, fetched_at = NOW()`
+	args := make([][]interface{}, 0)
+
+	for id, media := range playersMedia {
+		args = append(args, []interface{}{id, media.Avatar, media.Inset, media.MainRaw, media.RaceID, media.GearHash})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Inserted or updated media for %d players", numInserted)
+}
+
 func addItems(equippedItems map[int]item) {
 	// Make this method effectively single-threaded since so many players are
 	// wearing many of the same items - this avoids deadlocks at the DB level
@@ -369,6 +811,47 @@ func addItems(equippedItems map[int]item) {
 	logger.Printf("Inserted %d items", numInserted)
 }
 
+func getItemIDsNeedingDetails(ids []int, ttlHours int) []int {
+	needed := make([]int, 0)
+	if len(ids) == 0 {
+		return needed
+	}
+	rows, err := db.Query(`SELECT id FROM items WHERE id = ANY($1) AND
+		(details_last_update IS NULL OR details_last_update < NOW() - make_interval(hours => $2))`, ids, ttlHours)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return needed
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+		}
+		needed = append(needed, id)
+	}
+	return needed
+}
+
+func addItemDetails(details *[]itemDetails) {
+	const qry string = `UPDATE items SET icon=$2, item_class_id=$3, item_subclass_id=$4,
+		inventory_type=$5, required_level=$6, details_last_update=NOW() WHERE id=$1`
+	args := make([][]interface{}, 0)
+
+	for _, d := range *details {
+		// Do not unset icon if we couldn't retrieve it due to Blizzard API flakiness
+		if d.Icon == "" {
+			continue
+		}
+		params := []interface{}{d.ID, d.Icon, d.ClassID, d.SubclassID, d.InventoryType, d.RequiredLevel}
+		args = append(args, params)
+	}
+
+	numUpdated := insert(query{SQL: qry, Args: args})
+	logger.Printf("Updated details of %d items", numUpdated)
+}
+
 func setUpdateTime() {
 	execute(`INSERT INTO metadata (key, last_update) VALUES ('update_time', NOW())
 		ON CONFLICT (key) DO UPDATE SET last_update=NOW()`)
@@ -379,17 +862,22 @@ func purgeStalePlayers() {
 }
 
 func addRealms(realms *[]realm, region string) {
-	const qry string = `INSERT INTO realms (id, slug, name, region)
-	VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING`
+	// Metadata is only updated for realms found in a connected realm
+	const qry string = `INSERT INTO realms (id, slug, name, region, connected_realm_id, type, timezone, locale, category)
+	VALUES($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''))
+	ON CONFLICT (id) DO UPDATE SET connected_realm_id = COALESCE(EXCLUDED.connected_realm_id, realms.connected_realm_id),
+	type = COALESCE(EXCLUDED.type, realms.type), timezone = COALESCE(EXCLUDED.timezone, realms.timezone),
+	locale = COALESCE(EXCLUDED.locale, realms.locale), category = COALESCE(EXCLUDED.category, realms.category)`
 	args := make([][]interface{}, 0)
 
 	for _, realm := range *realms {
-		params := []interface{}{realm.ID, realm.Slug, realm.Name, region}
+		params := []interface{}{realm.ID, realm.Slug, realm.Name, region, realm.ConnectedRealmID,
+			realm.Type, realm.Timezone, realm.Locale, realm.Category}
 		args = append(args, params)
 	}
 
 	numInserted := insert(query{SQL: qry, Args: args})
-	logger.Printf("Inserted %d realms", numInserted)
+	logger.Printf("Inserted or updated %d realms", numInserted)
 }
 
 func addRaces(races *[]race) {
@@ -419,22 +907,53 @@ func addClasses(classes *[]class) {
 }
 
 func addSpecs(specs *[]spec) {
-	const qry string = `INSERT INTO specs (id, class_id, name, role, icon)
-		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO UPDATE SET icon = $5`
+	const qry string = `INSERT INTO specs (id, class_id, name, role, icon, slug, primary_stat,
+		male_description, female_description, talent_tree_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9, $10) ON CONFLICT (id) DO UPDATE SET
+		icon = COALESCE(EXCLUDED.icon, specs.icon), slug = $6, primary_stat = $7, male_description = $8,
+		female_description = $9, talent_tree_id = $10`
 	args := make([][]interface{}, 0)
 
 	for _, spec := range *specs {
-		params := []interface{}{spec.ID, spec.ClassID, spec.Name, spec.Role, spec.Icon}
-		// Do not unset icon if we couldn't retrieve it due to Blizzard API flakiness
-		if spec.Icon != "" {
-			args = append(args, params)
+		// Skip specs that couldn't be retrieved due to Blizzard API flakiness
+		if spec.ID == 0 || spec.ClassID == 0 {
+			continue
 		}
+		// An icon that couldn't be retrieved won't unset the existing one
+		params := []interface{}{spec.ID, spec.ClassID, spec.Name, spec.Role, spec.Icon, spec.Slug,
+			spec.PrimaryStat, spec.MaleDescription, spec.FemaleDescription, spec.TalentTreeID}
+		args = append(args, params)
 	}
 
 	numInserted := insert(query{SQL: qry, Args: args})
 	logger.Printf("Inserted or updated %d specs", numInserted)
 }
 
+func addSpecPvPTalents(specs *[]spec) {
+	const deleteQuery string = `DELETE FROM specs_pvp_talents WHERE spec_id = ANY($1)`
+	const qry string = `INSERT INTO specs_pvp_talents (spec_id, pvp_talent_id)
+		SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM pvp_talents WHERE id=$2)`
+	specIDs := make([]int, 0)
+	args := make([][]interface{}, 0)
+
+	// Only the links of specs that were retrieved are replaced
+	for _, spec := range *specs {
+		if len(spec.PvPTalentIDs) == 0 {
+			continue
+		}
+		specIDs = append(specIDs, spec.ID)
+		for _, id := range spec.PvPTalentIDs {
+			args = append(args, []interface{}{spec.ID, id})
+		}
+	}
+	if len(specIDs) == 0 {
+		return
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args, Before: deleteQuery, BeforeArgs: []interface{}{specIDs}})
+	logger.Printf("Mapped %d specs=>PvP talents", numInserted)
+}
+
 func addTalents(talents *[]talent) {
 	if len(*talents) == 0 {
 		return
@@ -443,12 +962,12 @@ func addTalents(talents *[]talent) {
 	execute(staleQuery)
 
 	const qry string = `INSERT INTO talents (id, spell_id, class_id, spec_id, name, icon,
-		node_id, display_row, display_col, stale, cat, hero_specs) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, FALSE, $10, $11) ON
-		CONFLICT (id) DO UPDATE SET spell_id = $2, class_id = $3, spec_id = $4, name = $5, icon = $6, node_id = $7, display_row = $8, display_col = $9, stale = FALSE, cat = $10, hero_specs = $11`
+		node_id, display_row, display_col, stale, cat, hero_specs, max_rank, choice_node, choice_index) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, FALSE, $10, $11, $12, $13, $14) ON
+		CONFLICT (id) DO UPDATE SET spell_id = $2, class_id = $3, spec_id = $4, name = $5, icon = $6, node_id = $7, display_row = $8, display_col = $9, stale = FALSE, cat = $10, hero_specs = $11, max_rank = $12, choice_node = $13, choice_index = $14`
 	args := make([][]interface{}, 0)
 
 	for _, talent := range *talents {
-		params := []interface{}{talent.ID, talent.SpellID, talent.ClassID, talent.SpecID, talent.Name, talent.Icon, talent.NodeID, talent.Row, talent.Col, talent.Cat, talent.HeroSpecs}
+		params := []interface{}{talent.ID, talent.SpellID, talent.ClassID, talent.SpecID, talent.Name, talent.Icon, talent.NodeID, talent.Row, talent.Col, talent.Cat, talent.HeroSpecs, talent.MaxRank, talent.ChoiceNode, talent.ChoiceIndex}
 		args = append(args, params)
 	}
 
@@ -459,6 +978,45 @@ func addTalents(talents *[]talent) {
 	execute(deleteStaleQuery)
 }
 
+func addTalentNodes(nodes *[]talentNode) {
+	if len(*nodes) == 0 {
+		return
+	}
+	const staleQuery string = `UPDATE talent_nodes SET stale=TRUE`
+	execute(staleQuery)
+
+	const qry string = `INSERT INTO talent_nodes (class_id, node_id, stale) VALUES ($1, $2, FALSE)
+		ON CONFLICT (class_id, node_id) DO UPDATE SET stale = FALSE`
+	args := make([][]interface{}, 0)
+
+	for _, node := range *nodes {
+		args = append(args, []interface{}{node.ClassID, node.NodeID})
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Inserted or updated %d talent nodes", numInserted)
+
+	const deleteStaleQuery string = `DELETE FROM talent_nodes WHERE stale=TRUE`
+	execute(deleteStaleQuery)
+}
+
+func addHeroTrees(heroTrees *[]heroTree) {
+	const qry string = `INSERT INTO hero_trees (id, name, class_id, icon, spec_ids)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET name = $2, class_id = $3,
+		icon = COALESCE(NULLIF($4, ''), hero_trees.icon), spec_ids = $5`
+	args := make([][]interface{}, 0)
+
+	// Icons that couldn't be retrieved (due to Blizzard API flakiness) won't unset existing ones
+	for _, tree := range *heroTrees {
+		params := []interface{}{tree.ID, tree.Name, tree.ClassID, tree.Icon, tree.SpecIDs}
+		args = append(args, params)
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Inserted or updated %d hero talent trees", numInserted)
+}
+
 func addPvPTalents(pvpTalents *[]pvpTalent) {
 	if len(*pvpTalents) == 0 {
 		return
@@ -466,13 +1024,16 @@ func addPvPTalents(pvpTalents *[]pvpTalent) {
 	const staleQuery string = `UPDATE pvp_talents SET stale=TRUE`
 	execute(staleQuery)
 
-	const qry string = `INSERT INTO pvp_talents (id, spell_id, spec_id, name, icon, stale)
-		VALUES ($1, $2, $3, $4, $5, FALSE)
-		ON CONFLICT (id) DO UPDATE SET name = $4, icon = $5, stale = FALSE`
+	const qry string = `INSERT INTO pvp_talents (id, spell_id, spec_id, name, icon, description,
+		compatible_slots, unlock_player_level, overrides_spell_id, stale)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, FALSE)
+		ON CONFLICT (id) DO UPDATE SET name = $4, icon = $5, description = $6, compatible_slots = $7,
+		unlock_player_level = $8, overrides_spell_id = $9, stale = FALSE`
 	args := make([][]interface{}, 0)
 
 	for _, talent := range *pvpTalents {
-		params := []interface{}{talent.ID, talent.SpellID, talent.SpecID, talent.Name, talent.Icon}
+		params := []interface{}{talent.ID, talent.SpellID, talent.SpecID, talent.Name, talent.Icon,
+			talent.Description, talent.CompatibleSlots, talent.UnlockPlayerLevel, talent.OverridesSpellID}
 		args = append(args, params)
 	}
 
@@ -484,12 +1045,14 @@ func addPvPTalents(pvpTalents *[]pvpTalent) {
 }
 
 func addAchievements(achievements *[]achievement) {
-	const qry string = `INSERT INTO achievements (id, name, description, icon)
-		VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET icon = $4`
+	const qry string = `INSERT INTO achievements (id, name, description, icon, bracket, tier, seasonal)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET icon = $4, bracket = $5, tier = $6, seasonal = $7`
 	args := make([][]interface{}, 0)
 
 	for _, achiev := range *achievements {
-		params := []interface{}{achiev.ID, achiev.Title, achiev.Description, achiev.Icon}
+		params := []interface{}{achiev.ID, achiev.Title, achiev.Description, achiev.Icon,
+			achiev.Tags.Bracket, achiev.Tags.Tier, achiev.Tags.Seasonal}
 		args = append(args, params)
 	}
 
@@ -497,6 +1060,43 @@ func addAchievements(achievements *[]achievement) {
 	logger.Printf("Inserted %d achievements", numInserted)
 }
 
+func addLocalizations(table string, localizations *[]localization) {
+	if len(*localizations) == 0 {
+		return
+	}
+	var qry string = fmt.Sprintf(`INSERT INTO %s (id, locale, name, description)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (id, locale) DO UPDATE SET name = $3, description = $4`, table)
+	args := make([][]interface{}, 0)
+
+	for _, l := range *localizations {
+		params := []interface{}{l.ID, l.Locale, l.Name, l.Description}
+		args = append(args, params)
+	}
+
+	numInserted := insert(query{SQL: qry, Args: args})
+	logger.Printf("Inserted or updated %d %s", numInserted, table)
+}
+
+func getItemIDsWithoutLocalizations() []int {
+	ids := make([]int, 0)
+	rows, err := db.Query(`SELECT id FROM items WHERE NOT EXISTS
+		(SELECT 1 FROM items_localizations WHERE items_localizations.id=items.id)`)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return ids
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 func getAchievementIds() map[int]bool {
 	var m map[int]bool = make(map[int]bool)
 	rows, err := db.Query("SELECT id FROM achievements")
@@ -533,47 +1133,148 @@ func getHeroTalentIds() map[int]bool {
 	return m
 }
 
-func getSpecIDForClassSpec(clazz string, spec string) int {
-	// Can't simply lookup IDs via names because in the solo shuffle key
-	// they strip out spaces (i.e. without a placeholder)
-	rows, err := db.Query("SELECT specs.id AS id, classes.name AS c, specs.name AS s FROM specs JOIN classes ON specs.class_id=classes.id")
+// Node IDs of each class's full talent tree (sorted ascending as required to
+// decode loadout strings) and the max rank of each node that has talents
+func getTalentNodes() (map[int][]int, map[int]int) {
+	var nodes map[int][]int = make(map[int][]int)
+	var maxRanks map[int]int = make(map[int]int)
+	rows, err := db.Query(`SELECT n.class_id, n.node_id, COALESCE(MAX(t.max_rank), 0) FROM talent_nodes n
+		LEFT JOIN talents t ON t.class_id=n.class_id AND t.node_id=n.node_id
+		GROUP BY n.class_id, n.node_id ORDER BY n.class_id, n.node_id`)
 	if err != nil {
 		logger.Printf("%s %s", errPrefix, err)
+		return nodes, maxRanks
 	}
 	defer rows.Close()
+	for rows.Next() {
+		var classID int
+		var nodeID int
+		var maxRank int
+		err := rows.Scan(&classID, &nodeID, &maxRank)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+		}
+		nodes[classID] = append(nodes[classID], nodeID)
+		if maxRank > 0 {
+			maxRanks[nodeID] = maxRank
+		}
+	}
+	return nodes, maxRanks
+}
+
+func addTalentTreeVersion(tree talentTreeVersion) {
+	const qry string = `INSERT INTO talent_trees (spec_id, version, node_count, node_ids, flagged, last_seen)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (spec_id, version) DO UPDATE SET node_count = $3, node_ids = $4, flagged = $5, last_seen = NOW()`
+	args := [][]interface{}{{tree.SpecID, tree.Version, len(tree.NodeIDs), tree.NodeIDs, tree.Flagged}}
+	insert(query{SQL: qry, Args: args})
+	logger.Printf("Recorded v%d of spec %d talent tree with %d nodes (flagged: %t)",
+		tree.Version, tree.SpecID, len(tree.NodeIDs), tree.Flagged)
+}
 
+// Highest unflagged version of each spec's talent tree
+func getLastGoodTalentTrees() map[int]talentTreeVersion {
+	trees := make(map[int]talentTreeVersion)
+	rows, err := db.Query(`SELECT DISTINCT ON (spec_id) spec_id, version, ARRAY_TO_STRING(node_ids, ',')
+		FROM talent_trees WHERE NOT flagged ORDER BY spec_id, version DESC`)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return trees
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var id int
-		var c string
-		var s string
-		err := rows.Scan(&id, &c, &s)
+		var tree talentTreeVersion
+		var nodeIDs string
+		err := rows.Scan(&tree.SpecID, &tree.Version, &nodeIDs)
 		if err != nil {
 			logger.Printf("%s %s", errPrefix, err)
-			return 0
+			continue
 		}
-		clazzSlug := strings.ReplaceAll(strings.ToLower(c), " ", "")
-		specSlug := strings.ReplaceAll(strings.ToLower(s), " ", "")
-		if clazzSlug == clazz && specSlug == spec {
-			return id
+		tree.NodeIDs = make([]int, 0)
+		for _, id := range strings.Split(nodeIDs, ",") {
+			if nodeID, err := strconv.Atoi(id); err == nil {
+				tree.NodeIDs = append(tree.NodeIDs, nodeID)
+			}
+		}
+		trees[tree.SpecID] = tree
+	}
+	return trees
+}
+
+func getSpecIDForClassSpec(clazz string, spec string) int {
+	// Slugs match the solo bracket keys which strip out spaces (i.e. without a placeholder)
+	rows, err := db.Query("SELECT id FROM specs WHERE slug=$1", clazz+"-"+spec)
+	if err != nil {
+		logger.Printf("%s %s", errPrefix, err)
+		return 0
+	}
+	defer rows.Close()
+
+	var id int
+	if rows.Next() {
+		err := rows.Scan(&id)
+		if err != nil {
+			logger.Printf("%s %s", errPrefix, err)
+			return 0
 		}
 	}
 
-	return 0
+	return id
 }
 
+// Slug of a realm, re-importing the current region's realms (at most once
+// per run) if the realm is unknown as new realms can appear mid-run. The
+// lock is only held to read or swap the map, never across the re-import
 func getRealmSlug(id int) string {
-	slug, ok := realmSlugs[id]
-	if ok {
+	if slug, ok := lookupRealmSlug(id); ok {
 		return slug
 	}
-	mapRealmSlugs()
-	return realmSlugs[id]
+	swapRealmSlugs(mapRealmSlugs())
+	if slug, ok := lookupRealmSlug(id); ok {
+		return slug
+	}
+
+	realmSlugsLock.Lock()
+	refresh, ok := realmRefreshes[region]
+	if !ok {
+		refresh = &sync.Once{}
+		realmRefreshes[region] = refresh
+	}
+	realmSlugsLock.Unlock()
+
+	refreshRegion := region
+	refresh.Do(func() {
+		logger.Printf("Realm %d unknown, refreshing %s realms", id, refreshRegion)
+		importRealms(refreshRegion)
+		swapRealmSlugs(mapRealmSlugs())
+	})
+	slug, _ := lookupRealmSlug(id)
+	return slug
+}
+
+func lookupRealmSlug(id int) (string, bool) {
+	realmSlugsLock.Lock()
+	defer realmSlugsLock.Unlock()
+	slug, ok := realmSlugs[id]
+	return slug, ok
+}
+
+// Replace the known realm slugs, keeping the current ones if the lookup failed
+func swapRealmSlugs(slugs map[int]string) {
+	if slugs == nil {
+		return
+	}
+	realmSlugsLock.Lock()
+	defer realmSlugsLock.Unlock()
+	realmSlugs = slugs
 }
 
-func mapRealmSlugs() {
+func mapRealmSlugs() map[int]string {
+	slugs := make(map[int]string)
 	rows, err := db.Query("SELECT id, slug FROM realms")
 	if err != nil {
 		logger.Printf("%s %s", errPrefix, err)
+		return nil
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -583,6 +1284,7 @@ func mapRealmSlugs() {
 		if err != nil {
 			logger.Printf("%s %s", errPrefix, err)
 		}
-		realmSlugs[id] = slug
+		slugs[id] = slug
 	}
+	return slugs
 }
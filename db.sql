@@ -213,6 +213,304 @@ ALTER TABLE talents ADD COLUMN hero_specs INTEGER[] NOT NULL DEFAULT ARRAY[]::IN
 CREATE INDEX ON talents (cat);
 CREATE INDEX ON talents (hero_specs);
 
+-- players imported by the current (possibly interrupted) run
+CREATE TABLE import_checkpoints (
+  realm_id INTEGER NOT NULL,
+  blizzard_id BIGINT NOT NULL,
+  region CHAR(2) NOT NULL,
+  PRIMARY KEY (realm_id, blizzard_id)
+);
+
+-- names (and descriptions) of static data in every locale
+CREATE TABLE races_localizations (
+  id INTEGER NOT NULL,
+  locale VARCHAR(8) NOT NULL,
+  name VARCHAR(128) NOT NULL,
+  description TEXT,
+  PRIMARY KEY (id, locale)
+);
+CREATE TABLE classes_localizations (LIKE races_localizations INCLUDING ALL);
+CREATE TABLE specs_localizations (LIKE races_localizations INCLUDING ALL);
+CREATE TABLE talents_localizations (LIKE races_localizations INCLUDING ALL);
+CREATE TABLE pvp_talents_localizations (LIKE races_localizations INCLUDING ALL);
+CREATE TABLE achievements_localizations (LIKE races_localizations INCLUDING ALL);
+CREATE TABLE items_localizations (
+  LIKE races_localizations INCLUDING ALL,
+  FOREIGN KEY (id) REFERENCES items (id) ON DELETE CASCADE
+);
+
+CREATE TABLE players_equipment (
+  player_id INTEGER NOT NULL REFERENCES players (id) ON DELETE CASCADE,
+  slot VARCHAR(32) NOT NULL,
+  item_id INTEGER NOT NULL,
+  item_level SMALLINT,
+  enchant_ids INTEGER[] NOT NULL DEFAULT ARRAY[]::INTEGER[],
+  enchant_names TEXT[] NOT NULL DEFAULT ARRAY[]::TEXT[],
+  gem_ids INTEGER[] NOT NULL DEFAULT ARRAY[]::INTEGER[],
+  bonus_ids INTEGER[] NOT NULL DEFAULT ARRAY[]::INTEGER[],
+  crafted_stats TEXT[] NOT NULL DEFAULT ARRAY[]::TEXT[],
+  set_id INTEGER NOT NULL DEFAULT 0,
+  embellished BOOLEAN NOT NULL DEFAULT FALSE,
+  PRIMARY KEY (player_id, slot)
+);
+CREATE INDEX ON players_equipment (item_id);
+ALTER TABLE players ADD COLUMN average_item_level NUMERIC(6, 2);
+
+ALTER TABLE items ADD COLUMN icon VARCHAR(128);
+ALTER TABLE items ADD COLUMN item_class_id INTEGER;
+ALTER TABLE items ADD COLUMN item_subclass_id INTEGER;
+ALTER TABLE items ADD COLUMN inventory_type VARCHAR(32);
+ALTER TABLE items ADD COLUMN required_level SMALLINT;
+ALTER TABLE items ADD COLUMN details_last_update TIMESTAMP;
+
+CREATE TABLE spec_item_popularity (
+  region CHAR(2) NOT NULL,
+  bracket VARCHAR(16) NOT NULL,
+  spec_id INTEGER NOT NULL,
+  rating_band VARCHAR(8) NOT NULL,
+  slot VARCHAR(32) NOT NULL,
+  item_id INTEGER NOT NULL,
+  players INTEGER NOT NULL,
+  percentage NUMERIC(5, 2) NOT NULL,
+  PRIMARY KEY (region, bracket, spec_id, rating_band, slot, item_id)
+);
+CREATE TABLE spec_set_popularity (
+  region CHAR(2) NOT NULL,
+  bracket VARCHAR(16) NOT NULL,
+  spec_id INTEGER NOT NULL,
+  rating_band VARCHAR(8) NOT NULL,
+  set_id INTEGER NOT NULL,
+  pieces SMALLINT NOT NULL,
+  players INTEGER NOT NULL,
+  percentage NUMERIC(5, 2) NOT NULL,
+  PRIMARY KEY (region, bracket, spec_id, rating_band, set_id, pieces)
+);
+CREATE TABLE spec_embellishment_popularity (
+  region CHAR(2) NOT NULL,
+  bracket VARCHAR(16) NOT NULL,
+  spec_id INTEGER NOT NULL,
+  rating_band VARCHAR(8) NOT NULL,
+  item_id INTEGER NOT NULL,
+  players INTEGER NOT NULL,
+  percentage NUMERIC(5, 2) NOT NULL,
+  PRIMARY KEY (region, bracket, spec_id, rating_band, item_id)
+);
+
+CREATE TABLE hero_trees (
+  id INTEGER PRIMARY KEY,
+  name VARCHAR(64) NOT NULL,
+  class_id INTEGER NOT NULL REFERENCES classes (id),
+  icon VARCHAR(128),
+  spec_ids INTEGER[] NOT NULL DEFAULT ARRAY[]::INTEGER[]
+);
+CREATE TABLE players_hero_trees (
+  player_id INTEGER PRIMARY KEY REFERENCES players (id) ON DELETE CASCADE,
+  hero_tree_id INTEGER NOT NULL,
+  hero_tree_name VARCHAR(64)
+);
+CREATE INDEX ON players_hero_trees (hero_tree_id);
+
+ALTER TABLE talents ADD COLUMN max_rank SMALLINT NOT NULL DEFAULT 1;
+ALTER TABLE talents ADD COLUMN choice_node BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE talents ADD COLUMN choice_index SMALLINT;
+ALTER TABLE players_talents ADD COLUMN rank SMALLINT NOT NULL DEFAULT 1;
+ALTER TABLE players_talents ADD COLUMN choice_index SMALLINT;
+
+CREATE TABLE players_loadouts (
+  player_id INTEGER PRIMARY KEY REFERENCES players (id) ON DELETE CASCADE,
+  loadout_code TEXT NOT NULL,
+  valid BOOLEAN NOT NULL DEFAULT FALSE
+);
+-- every node of each class's talent tree (including those without talents) as
+-- loadout strings encode a bit for each node in ascending order of node ID
+CREATE TABLE talent_nodes (
+  class_id INTEGER NOT NULL REFERENCES classes (id),
+  node_id INTEGER NOT NULL,
+  stale BOOLEAN DEFAULT TRUE,
+  PRIMARY KEY (class_id, node_id)
+);
+
+CREATE TABLE popular_builds (
+  region CHAR(2) NOT NULL,
+  bracket VARCHAR(16) NOT NULL,
+  spec_id INTEGER NOT NULL,
+  hero_tree_id INTEGER NOT NULL DEFAULT 0,
+  ranking SMALLINT NOT NULL,
+  signature CHAR(64) NOT NULL,
+  talent_ids INTEGER[] NOT NULL,
+  talent_ranks INTEGER[] NOT NULL,
+  players INTEGER NOT NULL,
+  cluster_players INTEGER NOT NULL,
+  sample_size INTEGER NOT NULL,
+  avg_rating NUMERIC(6, 2),
+  PRIMARY KEY (region, bracket, spec_id, hero_tree_id, ranking)
+);
+
+CREATE TABLE talent_trees (
+  spec_id INTEGER NOT NULL,
+  version INTEGER NOT NULL,
+  node_count SMALLINT NOT NULL,
+  node_ids INTEGER[] NOT NULL,
+  flagged BOOLEAN NOT NULL DEFAULT FALSE,
+  last_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (spec_id, version)
+);
+
+ALTER TABLE pvp_talents ADD COLUMN description TEXT;
+ALTER TABLE pvp_talents ADD COLUMN compatible_slots INTEGER[] NOT NULL DEFAULT ARRAY[]::INTEGER[];
+ALTER TABLE pvp_talents ADD COLUMN unlock_player_level SMALLINT;
+ALTER TABLE pvp_talents ADD COLUMN overrides_spell_id INTEGER;
+ALTER TABLE players_pvp_talents ADD COLUMN slot SMALLINT;
+
+ALTER TABLE specs ADD COLUMN slug VARCHAR(64);
+ALTER TABLE specs ADD COLUMN primary_stat VARCHAR(16);
+ALTER TABLE specs ADD COLUMN male_description TEXT;
+ALTER TABLE specs ADD COLUMN female_description TEXT;
+ALTER TABLE specs ADD COLUMN talent_tree_id INTEGER;
+CREATE INDEX ON specs (slug);
+CREATE TABLE specs_pvp_talents (
+  spec_id INTEGER NOT NULL REFERENCES specs (id),
+  pvp_talent_id INTEGER NOT NULL REFERENCES pvp_talents (id) ON DELETE CASCADE,
+  PRIMARY KEY (spec_id, pvp_talent_id)
+);
+
+CREATE TABLE players_media (
+  player_id INTEGER PRIMARY KEY REFERENCES players (id) ON DELETE CASCADE,
+  avatar VARCHAR(256),
+  inset VARCHAR(256),
+  main_raw VARCHAR(256),
+  race_id INTEGER,
+  gear_hash VARCHAR(64),
+  fetched_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE players_achievements ADD COLUMN completed_at TIMESTAMP;
+CREATE TABLE pvp_seasons (
+  id INTEGER PRIMARY KEY,
+  start_time TIMESTAMP NOT NULL,
+  end_time TIMESTAMP
+);
+CREATE TABLE players_accolades (
+  player_id INTEGER NOT NULL REFERENCES players (id) ON DELETE CASCADE,
+  kind VARCHAR(16) NOT NULL,
+  accolade_id INTEGER NOT NULL,
+  name VARCHAR(256),
+  achieved_at TIMESTAMP,
+  first_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+  season_id INTEGER,
+  PRIMARY KEY (player_id, kind, accolade_id)
+);
+
+ALTER TABLE achievements ADD COLUMN bracket VARCHAR(16);
+ALTER TABLE achievements ADD COLUMN tier VARCHAR(32);
+ALTER TABLE achievements ADD COLUMN seasonal BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE guilds (
+  id SERIAL PRIMARY KEY,
+  realm_id INTEGER NOT NULL REFERENCES realms (id),
+  blizzard_id BIGINT NOT NULL,
+  name VARCHAR(64) NOT NULL,
+  faction_id INTEGER REFERENCES factions (id),
+  last_update TIMESTAMP NOT NULL DEFAULT NOW(),
+  UNIQUE (realm_id, blizzard_id)
+);
+ALTER TABLE players ADD COLUMN guild_id INTEGER REFERENCES guilds (id) ON DELETE SET NULL;
+CREATE TABLE guild_rankings (
+  region CHAR(2) NOT NULL,
+  bracket VARCHAR(16) NOT NULL,
+  guild_id INTEGER NOT NULL REFERENCES guilds (id) ON DELETE CASCADE,
+  members INTEGER NOT NULL,
+  best_rating SMALLINT NOT NULL,
+  avg_rating NUMERIC(6, 2) NOT NULL,
+  PRIMARY KEY (region, bracket, guild_id)
+);
+
+ALTER TABLE realms ADD COLUMN connected_realm_id INTEGER;
+ALTER TABLE realms ADD COLUMN type VARCHAR(16);
+ALTER TABLE realms ADD COLUMN timezone VARCHAR(64);
+ALTER TABLE realms ADD COLUMN locale VARCHAR(8);
+ALTER TABLE realms ADD COLUMN category VARCHAR(64);
+CREATE INDEX ON realms (connected_realm_id);
+
+-- inferred teams are replaced each run so player IDs
+-- of purged players don't linger for long
+CREATE TABLE inferred_teams (
+  id SERIAL PRIMARY KEY,
+  region CHAR(2) NOT NULL,
+  bracket CHAR(3) NOT NULL,
+  player_ids INTEGER[] NOT NULL,
+  wins SMALLINT NOT NULL,
+  losses SMALLINT NOT NULL,
+  rating SMALLINT NOT NULL,
+  confidence NUMERIC(4, 3) NOT NULL
+);
+CREATE INDEX ON inferred_teams (region, bracket);
+CREATE TABLE composition_stats (
+  region CHAR(2) NOT NULL,
+  bracket CHAR(3) NOT NULL,
+  spec_ids INTEGER[] NOT NULL,
+  teams INTEGER NOT NULL,
+  percentage NUMERIC(5, 2) NOT NULL,
+  avg_rating NUMERIC(6, 2) NOT NULL,
+  max_rating SMALLINT NOT NULL,
+  avg_confidence NUMERIC(4, 3) NOT NULL,
+  PRIMARY KEY (region, bracket, spec_ids)
+);
+
+CREATE TABLE representation_history (
+  run_at TIMESTAMP NOT NULL,
+  region CHAR(2) NOT NULL,
+  bracket VARCHAR(16) NOT NULL,
+  rating_band VARCHAR(8) NOT NULL,
+  dimension VARCHAR(16) NOT NULL,
+  value_id INTEGER NOT NULL,
+  players INTEGER NOT NULL,
+  percentage NUMERIC(5, 2) NOT NULL,
+  PRIMARY KEY (run_at, region, bracket, rating_band, dimension, value_id)
+);
+
+CREATE TABLE stat_distributions (
+  region CHAR(2) NOT NULL,
+  bracket VARCHAR(16) NOT NULL,
+  spec_id INTEGER NOT NULL,
+  stat VARCHAR(16) NOT NULL,
+  players INTEGER NOT NULL,
+  mean REAL NOT NULL,
+  median REAL NOT NULL,
+  p10 REAL NOT NULL,
+  p25 REAL NOT NULL,
+  p75 REAL NOT NULL,
+  p90 REAL NOT NULL,
+  rating_weighted BOOLEAN NOT NULL DEFAULT FALSE,
+  PRIMARY KEY (region, bracket, spec_id, stat)
+);
+
+CREATE TABLE run_validations (
+  run_at TIMESTAMP NOT NULL,
+  region CHAR(2) NOT NULL,
+  check_name VARCHAR(32) NOT NULL,
+  bracket VARCHAR(16) NOT NULL DEFAULT '',
+  value REAL NOT NULL,
+  threshold REAL NOT NULL,
+  passed BOOLEAN NOT NULL,
+  outcome VARCHAR(8) NOT NULL,
+  PRIMARY KEY (run_at, region, check_name, bracket)
+);
+
+CREATE TABLE player_fetch_failures (
+  realm_id INTEGER NOT NULL,
+  blizzard_id BIGINT NOT NULL,
+  region CHAR(2) NOT NULL,
+  endpoint VARCHAR(32) NOT NULL,
+  status SMALLINT NOT NULL,
+  failures INTEGER NOT NULL DEFAULT 1,
+  not_found_count INTEGER NOT NULL DEFAULT 0,
+  last_failed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  cooldown_until TIMESTAMP,
+  PRIMARY KEY (realm_id, blizzard_id)
+);
+CREATE INDEX ON player_fetch_failures (region, cooldown_until);
+
 -- create a stored proc to remove players (and associated data) for those
 -- that are not currently on a leaderboard
 CREATE OR REPLACE FUNCTION purge_old_players()
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+/* Tracking of players whose details couldn't be retrieved */
+
+// Players not found this many runs in a row aren't fetched again until the cooldown ends
+var notFoundCooldownThreshold int = max(getEnvVarOrDefault("NOT_FOUND_COOLDOWN_THRESHOLD", 3), 1)
+var notFoundCooldownHours int = getEnvVarOrDefault("NOT_FOUND_COOLDOWN_HOURS", 72)
+
+const topFailureReasons int = 5
+
+// fetchFailure : the endpoint and HTTP status (0 if no response) of a failed request
+type fetchFailure struct {
+	Endpoint string
+	Status   int
+}
+
+// Not found players (e.g. renamed, transferred or restricted characters) won't succeed on retry
+func (f fetchFailure) transient() bool {
+	return f.Status != http.StatusNotFound
+}
+
+func (f fetchFailure) String() string {
+	if f.Status == 0 {
+		return fmt.Sprintf("%s (no response)", f.Endpoint)
+	}
+	return fmt.Sprintf("%s (HTTP %d)", f.Endpoint, f.Status)
+}
+
+// Players with transient failures awaiting a retry, whether they're being retried,
+// how many failed again when retried and the failures seen this run
+var transientFailures []*player
+var retryingFailures bool
+var failedRetries int
+var failureCounts map[fetchFailure]int = make(map[fetchFailure]int)
+var failuresLock sync.Mutex
+
+// Set aside results with a transient failure to be retried, returning the rest. Set
+// aside players aren't counted or recorded until the outcome of their retry is known.
+func deferTransientFailures(results []playerResult) []playerResult {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	remaining := make([]playerResult, 0, len(results))
+	for _, result := range results {
+		if result.Failure != nil && result.Failure.transient() {
+			if !retryingFailures {
+				transientFailures = append(transientFailures, result.Player)
+				continue
+			}
+			failedRetries++
+		}
+		remaining = append(remaining, result)
+	}
+	return remaining
+}
+
+func recordFetchFailures(results []playerResult) {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	for _, result := range results {
+		if result.Failure != nil {
+			failureCounts[*result.Failure]++
+		}
+	}
+}
+
+// Players with transient failures since the last call
+func takeTransientFailures() []*player {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	players := transientFailures
+	transientFailures = nil
+	return players
+}
+
+func setRetryingFailures(retrying bool) {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	retryingFailures = retrying
+	if retrying {
+		failedRetries = 0
+	}
+}
+
+func getFailedRetries() int {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	return failedRetries
+}
+
+// Retry players whose details couldn't be retrieved due to a transient failure (once)
+func retryTransientFailures() {
+	players := takeTransientFailures()
+	if len(players) == 0 {
+		return
+	}
+	logger.Printf("Retrying %d %s players with transient failures", len(players), region)
+	setRetryingFailures(true)
+	importPlayers(players)
+	setRetryingFailures(false)
+	logger.Printf("%d of %d %s players still failing after retry", getFailedRetries(), len(players), region)
+}
+
+func skipCoolingDownPlayers(players []*player, coolingDown map[string]bool) []*player {
+	if len(coolingDown) == 0 {
+		return players
+	}
+	remaining := make([]*player, 0, len(players))
+	for _, player := range players {
+		if coolingDown[playerKey(player.RealmID, player.BlizzardID)] {
+			continue
+		}
+		remaining = append(remaining, player)
+	}
+	logger.Printf("Skipping %d players repeatedly not found", len(players)-len(remaining))
+	return remaining
+}
+
+// The most frequent failures, most frequent first
+func topFailures(counts map[fetchFailure]int, n int) []fetchFailure {
+	failures := make([]fetchFailure, 0, len(counts))
+	for failure := range counts {
+		failures = append(failures, failure)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if counts[failures[i]] == counts[failures[j]] {
+			return failures[i].String() < failures[j].String()
+		}
+		return counts[failures[i]] > counts[failures[j]]
+	})
+	if len(failures) > n {
+		failures = failures[:n]
+	}
+	return failures
+}
+
+func reportFetchFailures() {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	if len(failureCounts) == 0 {
+		return
+	}
+	logger.Println("Top player fetch failures:")
+	for _, failure := range topFailures(failureCounts, topFailureReasons) {
+		logger.Printf("  %s: %d", failure, failureCounts[failure])
+	}
+}
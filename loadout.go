@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/* Decoding of the in-game talent loadout import/export string */
+
+const loadoutChars string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+const loadoutBitsPerChar int = 6
+const loadoutVersionBits int = 8
+const loadoutSpecBits int = 16
+const loadoutTreeHashBytes int = 16
+const loadoutRanksBits int = 6
+const loadoutChoiceBits int = 2
+
+// Version 2 added the "purchased" flag to distinguish granted nodes
+const loadoutPurchasedVersion int = 2
+
+// loadoutNode : a node's selection as encoded in a loadout string
+type loadoutNode struct {
+	NodeID      int
+	Purchased   bool
+	Ranks       int
+	FullyRanked bool
+	ChoiceNode  bool
+	ChoiceIndex int
+}
+
+// loadout : a decoded loadout string, keyed by selected node ID
+type loadout struct {
+	Version  int
+	SpecID   int
+	TreeHash []byte
+	Nodes    map[int]loadoutNode
+}
+
+// loadoutReader : reads values from a loadout string, least significant bit first
+type loadoutReader struct {
+	values []int
+	bitPos int
+}
+
+func newLoadoutReader(code string) (*loadoutReader, error) {
+	values := make([]int, 0, len(code))
+	for _, c := range strings.TrimRight(code, "=") {
+		value := strings.IndexRune(loadoutChars, c)
+		if value < 0 {
+			return nil, fmt.Errorf("invalid loadout character '%c'", c)
+		}
+		values = append(values, value)
+	}
+	return &loadoutReader{values: values}, nil
+}
+
+func (r *loadoutReader) read(bits int) (int, error) {
+	value := 0
+	for i := 0; i < bits; i++ {
+		index := r.bitPos / loadoutBitsPerChar
+		if index >= len(r.values) {
+			return 0, errors.New("loadout string ended unexpectedly")
+		}
+		bit := (r.values[index] >> (r.bitPos % loadoutBitsPerChar)) & 1
+		value |= bit << i
+		r.bitPos++
+	}
+	return value, nil
+}
+
+// Decode a loadout string. Selections are encoded in the order of the class's
+// full talent tree so nodeIDs must be every node in the tree sorted ascending.
+func decodeLoadout(code string, nodeIDs []int) (loadout, error) {
+	decoded := loadout{Nodes: make(map[int]loadoutNode)}
+	reader, err := newLoadoutReader(code)
+	if err != nil {
+		return decoded, err
+	}
+
+	if decoded.Version, err = reader.read(loadoutVersionBits); err != nil {
+		return decoded, err
+	}
+	if decoded.SpecID, err = reader.read(loadoutSpecBits); err != nil {
+		return decoded, err
+	}
+	decoded.TreeHash = make([]byte, 0, loadoutTreeHashBytes)
+	for i := 0; i < loadoutTreeHashBytes; i++ {
+		b, err := reader.read(8)
+		if err != nil {
+			return decoded, err
+		}
+		decoded.TreeHash = append(decoded.TreeHash, byte(b))
+	}
+
+	for _, nodeID := range nodeIDs {
+		selected, err := reader.read(1)
+		if err != nil {
+			return decoded, err
+		}
+		if selected == 0 {
+			continue
+		}
+		node := loadoutNode{NodeID: nodeID, Purchased: true, FullyRanked: true}
+		if decoded.Version >= loadoutPurchasedVersion {
+			purchased, err := reader.read(1)
+			if err != nil {
+				return decoded, err
+			}
+			node.Purchased = purchased == 1
+		}
+		if node.Purchased {
+			partial, err := reader.read(1)
+			if err != nil {
+				return decoded, err
+			}
+			if partial == 1 {
+				node.FullyRanked = false
+				if node.Ranks, err = reader.read(loadoutRanksBits); err != nil {
+					return decoded, err
+				}
+			}
+			choice, err := reader.read(1)
+			if err != nil {
+				return decoded, err
+			}
+			if choice == 1 {
+				node.ChoiceNode = true
+				if node.ChoiceIndex, err = reader.read(loadoutChoiceBits); err != nil {
+					return decoded, err
+				}
+			}
+		}
+		decoded.Nodes[nodeID] = node
+	}
+
+	return decoded, nil
+}
+
+// Check a decoded loadout selects the same nodes (at the same ranks) as the
+// talents selected by the player, using maxRanks for fully ranked nodes. Nodes
+// without talents (absent from maxRanks, e.g. hero tree selection) are ignored.
+func loadoutMatches(decoded loadout, talents []selectedTalent, maxRanks map[int]int) bool {
+	selectedNodes := make(map[int]bool, len(talents))
+	for _, talent := range talents {
+		selectedNodes[talent.NodeID] = true
+		node, exists := decoded.Nodes[talent.NodeID]
+		if !exists {
+			return false
+		}
+		ranks := node.Ranks
+		if node.FullyRanked {
+			ranks = maxRanks[talent.NodeID]
+		}
+		if ranks > 0 && ranks != talent.Rank {
+			return false
+		}
+	}
+	for nodeID, node := range decoded.Nodes {
+		if _, hasTalents := maxRanks[nodeID]; hasTalents && node.Purchased && !selectedNodes[nodeID] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a player's loadout string decodes to the talents stored for them
+func validateLoadout(code string, classID int, talents []selectedTalent) bool {
+	decoded, err := decodeLoadout(code, talentNodesByClass[classID])
+	if err != nil {
+		logger.Printf("%s decoding loadout '%s' failed: %s", warnPrefix, code, err)
+		return false
+	}
+	return loadoutMatches(decoded, talents, talentNodeMaxRanks)
+}
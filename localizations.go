@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var importAllLocales bool = getEnvVarOrDefault("IMPORT_ALL_LOCALES", 0) == 1
+
+// localizedString : API string containing either a single locale's value or
+// (when no locale is requested) an object with the value in every locale
+type localizedString map[string]string
+
+func (l *localizedString) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*l = localizedString{defaultLocale: single}
+		return nil
+	}
+	var all map[string]string
+	err := json.Unmarshal(data, &all)
+	if err != nil {
+		return err
+	}
+	*l = all
+	return nil
+}
+
+// Translations of a name and (optional) description, sorted by locale
+func localizationsFor(id int, name localizedString, description localizedString) []localization {
+	locales := make([]string, 0, len(name))
+	for locale := range name {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+
+	localizations := make([]localization, 0, len(locales))
+	for _, locale := range locales {
+		if name[locale] == "" {
+			continue
+		}
+		localizations = append(localizations, localization{id, locale, name[locale], description[locale]})
+	}
+	return localizations
+}
+
+// Parses an index whose (single) list of ID/name elements is under listKey
+func parseLocalizedIndex(data *[]byte, listKey string) []localization {
+	type LocalizedJSON struct {
+		ID   int
+		Name localizedString
+	}
+	var index map[string]json.RawMessage
+	err := safeUnmarshal(data, &index)
+	if err != nil {
+		logger.Printf("%s parsing %s localizations failed: %s", warnPrefix, listKey, err)
+		return make([]localization, 0)
+	}
+	var elements []LocalizedJSON
+	err = json.Unmarshal(index[listKey], &elements)
+	if err != nil {
+		logger.Printf("%s parsing %s localizations failed: %s", warnPrefix, listKey, err)
+		return make([]localization, 0)
+	}
+
+	localizations := make([]localization, 0)
+	for _, element := range elements {
+		localizations = append(localizations, localizationsFor(element.ID, element.Name, nil)...)
+	}
+	return localizations
+}
+
+// Store the name of static entities in every locale alongside the
+// English (default) names imported by importStaticData
+func importLocalizations() {
+	logger.Println("Beginning import of localizations")
+	importIndexLocalizations("playable-race/index", "races", "races_localizations")
+	importIndexLocalizations("playable-class/index", "classes", "classes_localizations")
+	importIndexLocalizations("playable-specialization/index", "character_specializations", "specs_localizations")
+	importIndexLocalizations("talent/index", "talents", "talents_localizations")
+	importIndexLocalizations("pvp-talent/index", "pvp_talents", "pvp_talents_localizations")
+	importAchievementLocalizations()
+	logger.Println("Localizations import complete")
+}
+
+func importIndexLocalizations(path string, listKey string, table string) {
+	var indexJSON *[]byte = getStaticAllLocales(region, path)
+	localizations := parseLocalizedIndex(indexJSON, listKey)
+	logger.Printf("Found %d %s localizations", len(localizations), listKey)
+	addLocalizations(table, &localizations)
+}
+
+func importAchievementLocalizations() {
+	ids := make([]int, 0)
+	for id := range getAchievementIds() {
+		ids = append(ids, id)
+	}
+	localizations := getLocalizationsByID(ids, "achievement/%d")
+	logger.Printf("Found %d achievement localizations", len(localizations))
+	addLocalizations("achievements_localizations", &localizations)
+}
+
+// Only items without any translations are retrieved as
+// (unlike other static data) new items are seen every run
+func importItemLocalizations() {
+	ids := getItemIDsWithoutLocalizations()
+	if len(ids) == 0 {
+		return
+	}
+	localizations := getLocalizationsByID(ids, "item/%d")
+	logger.Printf("Found %d localizations for %d items", len(localizations), len(ids))
+	addLocalizations("items_localizations", &localizations)
+}
+
+func getLocalizationsByID(ids []int, pathFormat string) []localization {
+	type LocalizedJSON struct {
+		ID          int
+		Name        localizedString
+		Description localizedString
+	}
+	var localizations []localization = make([]localization, 0)
+	var mutex sync.Mutex
+	fetchAll(ids, func(id int) {
+		var localizedJSON *[]byte = getStaticAllLocales(region, fmt.Sprintf(pathFormat, id))
+		if localizedJSON == nil {
+			return
+		}
+		var l LocalizedJSON
+		err := safeUnmarshal(localizedJSON, &l)
+		if err != nil {
+			return
+		}
+		mutex.Lock()
+		localizations = append(localizations, localizationsFor(id, l.Name, l.Description)...)
+		mutex.Unlock()
+	})
+	return localizations
+}
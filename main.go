@@ -9,9 +9,9 @@ import (
 	"math"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	cmap "github.com/orcaman/concurrent-map/v2"
@@ -24,11 +24,16 @@ const fatalPrefix string = "[FATAL]"
 const warnPrefix string = "[WARN]"
 
 var loginStaleSeconds int64 = int64(getEnvVarOrDefault("LAST_LOGIN_STALE_HOURS", 999) * 60 * 60)
+var checkpointMaxAgeSeconds int64 = int64(getEnvVarOrDefault("CHECKPOINT_MAX_AGE_HOURS", 12) * 60 * 60)
 
 var region = "US"
-var regions = []string{"EU", "US"}
+var regions = parseRegions(getEnvVarStringOrDefault("REGIONS", "EU,US"))
 
 var heroTalentIds map[int]bool
+var talentNodesByClass map[int][]int
+var talentNodeMaxRanks map[int]int
+
+var textureMarkup = regexp.MustCompile(`\|A:[^|]*\|a`)
 
 func main() {
 	start := time.Now()
@@ -36,10 +41,11 @@ func main() {
 	importStaticData()
 	heroTalentIds = getHeroTalentIds()
 	logger.Printf("Cached %d hero talent IDs", len(heroTalentIds))
-	maxConnections := getEnvVarOrDefault("MAX_DB_CONNECTIONS", defaultMaxDbConnections)
+	talentNodesByClass, talentNodeMaxRanks = getTalentNodes()
+	logger.Printf("Cached %d talent nodes", len(talentNodeMaxRanks))
 	season := getCurrentSeason()
 	foundPlayers := false
-	markStalePlayerTalents()
+	importedPlayers := resumeOrBeginImportRun()
 	for _, r := range regions {
 		region = r
 		leaderboards := make(map[string][]leaderboardEntry)
@@ -84,37 +90,96 @@ func main() {
 		} else {
 			foundPlayers = true
 		}
-		groupSize := len(players) / (maxConnections / 2)
-		groups := split(players, groupSize)
-		var waitGroup sync.WaitGroup
-		waitGroup.Add(len(groups))
-
-		// Player items/gear will have A LOT of overlap so use a
-		// singular global collection for that so all the upserts
-		// are minimized and happen only once per update.
-		playersItems := cmap.New[items]()
-
-		for _, group := range groups {
-			go importPlayers(group, &waitGroup, &playersItems)
+		players = skipImportedPlayers(players, importedPlayers)
+		players = skipCoolingDownPlayers(players, getPlayersInCooldown())
+		resetRunMetrics()
+		if len(players) > 0 {
+			importPlayers(players)
+			retryTransientFailures()
+		}
+		if importAllLocales {
+			importItemLocalizations()
 		}
-		waitGroup.Wait()
-
-		addItems(squashItems(&playersItems))
-		addPlayerItems(&playersItems)
 
+		blocked := validateRegion(leaderboards)
+		if len(blocked) == len(leaderboards) {
+			logger.Printf("%s %s failed validation, leaving its leaderboards unchanged", warnPrefix, region)
+			continue
+		}
+		// Must precede updating leaderboards as the stored ones are the prior snapshot
+		updateInferredTeams(leaderboards, blocked)
+		ranked := make([]string, 0, len(leaderboards))
 		for bracket, leaderboard := range leaderboards {
+			ranked = append(ranked, bracket)
+			if blocked[bracket] {
+				logger.Printf("%s %s %s failed validation, leaving it unchanged", warnPrefix, region, bracket)
+				continue
+			}
 			updateLeaderboard(bracket, leaderboard)
 		}
+		updateAggregates(ranked)
 	}
 	if foundPlayers {
 		logger.Println("Cleaning up...")
 		purgeStalePlayers()
 		setUpdateTime()
+		// Only a complete pass may purge, anything short of
+		// this leaves the run open to be resumed
+		completeImportRun()
 	}
+	reportFetchFailures()
 	end := time.Now()
 	logger.Printf("Updating PvPLeaderBoard Complete after %v", end.Sub(start))
 }
 
+// Resume an interrupted import run if it is recent enough, returning the
+// keys of players it already imported, otherwise begin a fresh run.
+func resumeOrBeginImportRun() map[string]bool {
+	started := getImportRunStart()
+	if isResumableImportRun(started, time.Now().Unix()) {
+		imported := getImportCheckpoints()
+		logger.Printf("Resuming import run started at %v with %d players already imported",
+			time.Unix(started, 0), len(imported))
+		return imported
+	}
+	if started > 0 {
+		logger.Printf("%s Abandoning import run started at %v", warnPrefix, time.Unix(started, 0))
+	}
+	beginImportRun()
+	return make(map[string]bool)
+}
+
+// A run (started at epoch seconds, 0 if none) is resumed unless it's too old
+func isResumableImportRun(started int64, now int64) bool {
+	return started > 0 && (now-started) < checkpointMaxAgeSeconds
+}
+
+func skipImportedPlayers(players []*player, importedPlayers map[string]bool) []*player {
+	if len(importedPlayers) == 0 {
+		return players
+	}
+	remaining := make([]*player, 0, len(players))
+	for _, player := range players {
+		if importedPlayers[playerKey(player.RealmID, player.BlizzardID)] {
+			continue
+		}
+		remaining = append(remaining, player)
+	}
+	logger.Printf("Skipping %d players already imported this run", len(players)-len(remaining))
+	return remaining
+}
+
+func parseRegions(list string) []string {
+	regions := make([]string, 0)
+	for _, r := range strings.Split(list, ",") {
+		r = strings.ToUpper(strings.TrimSpace(r))
+		if r != "" {
+			regions = append(regions, r)
+		}
+	}
+	return regions
+}
+
 func getEnvVar(envVar string) string {
 	var value string = os.Getenv(envVar)
 	if value == "" {
@@ -124,6 +189,14 @@ func getEnvVar(envVar string) string {
 	return value
 }
 
+func getEnvVarStringOrDefault(envVar string, defaultValue string) string {
+	var value string = os.Getenv(envVar)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
 func getEnvVarOrDefault(envVar string, defaultValue int) int {
 	var size = os.Getenv(envVar)
 	if size == "" {
@@ -138,24 +211,6 @@ func getEnvVarOrDefault(envVar string, defaultValue int) int {
 	return i
 }
 
-func split(slice []*player, groupSize int) [][]*player {
-	groups := make([][]*player, 0)
-	if len(slice) <= groupSize {
-		return append(groups, slice)
-	}
-
-	group := make([]*player, 0)
-	for i, p := range slice {
-		group = append(group, p)
-		if (i+1)%groupSize == 0 {
-			groups = append(groups, group)
-			group = make([]*player, 0)
-		}
-	}
-
-	return groups
-}
-
 func getCurrentSeason() int {
 	type Seasons struct {
 		Seasons       []keyedValue
@@ -287,91 +342,60 @@ func getPlayersFromLeaderboards(leaderboards map[string][]leaderboardEntry) []*p
 			if exists {
 				continue
 			}
-			path := fmt.Sprintf("%s/%s",
-				getRealmSlug(entry.RealmID), url.QueryEscape(strings.ToLower(entry.Name)))
 			player := player{
 				Name:       entry.Name,
 				BlizzardID: entry.BlizzardID,
 				RealmID:    entry.RealmID,
-				Path:       path}
+				Path:       playerPath(getRealmSlug(entry.RealmID), entry.Name)}
 			players[key] = &player
 		}
 	}
-	var p []*player = make([]*player, 0)
-	for _, player := range players {
-		p = append(p, player)
-	}
-	return p
+	return prioritizePlayers(players, leaderboards, getPlayersLastUpdate(), time.Now().Unix())
 }
 
-func playerKey(realmID, blizzardID int) string {
-	return fmt.Sprintf("%d-%d", realmID, blizzardID)
+// KR and TW realm slugs and character names are often non-Latin so both are
+// escaped as path segments (names must be lowercase for the profile API)
+func playerPath(realmSlug, name string) string {
+	return fmt.Sprintf("%s/%s", url.PathEscape(realmSlug), url.PathEscape(strings.ToLower(name)))
 }
 
-func importPlayers(players []*player, waitGroup *sync.WaitGroup, playersItems *cmap.ConcurrentMap[string, items]) {
-	defer waitGroup.Done()
-	logger.Printf("Importing %d players", len(players))
-	for _, player := range players {
-		setPlayerDetails(player)
-	}
-	foundPlayers := make([]*player, 0)
-	stalePlayers := 0
-	nowish := time.Now().Unix()
-	for _, player := range players {
-		if player.ClassID == 0 {
-			continue
-		}
-		if (nowish - player.LastLogin) > loginStaleSeconds {
-			stalePlayers++
-			continue
-		}
-		foundPlayers = append(foundPlayers, player)
+func factionID(factionType string) int {
+	if factionType == "HORDE" {
+		return 67
 	}
+	return 469
+}
 
-	logger.Printf("Found %d of %d players, including %d stale players", (len(foundPlayers) + stalePlayers), len(players), stalePlayers)
-	addPlayers(foundPlayers)
-	var playerIDs map[string]int = getPlayerIDs(foundPlayers)
-	var pvpAchievements map[int]bool = getAchievementIds()
-
-	var playersTalents map[int]playerTalents = make(map[int]playerTalents, 0)
-	var playersStats map[int]stats = make(map[int]stats, 0)
-	var playersAchievements map[int][]int = make(map[int][]int, 0)
-	for profilePath, dbID := range playerIDs {
-		playerTalents := getPlayerTalents(profilePath)
-		// If we couldn't get the player's talents don't bother attempting other data
-		if len(playerTalents.Talents) == 0 {
-			continue
-		}
-		playersTalents[dbID] = playerTalents
-		playersStats[dbID] = getPlayerStats(profilePath)
-		playersAchievements[dbID] = getPlayerAchievements(profilePath, pvpAchievements)
-
-		(*playersItems).SetIfAbsent(strconv.Itoa(dbID), getPlayerItems(profilePath))
-	}
-	addPlayerTalents(playersTalents)
-	addPlayerStats(playersStats)
-	addPlayerAchievements(playersAchievements)
+func playerKey(realmID, blizzardID int) string {
+	return fmt.Sprintf("%d-%d", realmID, blizzardID)
 }
 
-func setPlayerDetails(player *player) {
+// Returns the failure (if any) of retrieving the player's profile
+func setPlayerDetails(player *player) *fetchFailure {
+	type GuildJSON struct {
+		Name    string
+		ID      int
+		Realm   keyedValue
+		Faction typedName
+	}
 	type ProfileJSON struct {
 		Gender         typedName
 		Faction        typedName
 		Race           keyedValue
 		CharacterClass keyedValue `json:"character_class"`
 		ActiveSpec     keyedValue `json:"active_spec"`
-		Guild          keyedValue
+		Guild          GuildJSON
 		LastLogin      int64 `json:"last_login_timestamp"`
 	}
-	var profileJSON *[]byte = getProfile(region, player.Path)
+	profileJSON, status := getProfileWithStatus(region, player.Path)
 	if profileJSON == nil {
-		return
+		return &fetchFailure{"profile", status}
 	}
 	var profile ProfileJSON
 	err := safeUnmarshal(profileJSON, &profile)
 	if err != nil {
 		logger.Printf("%s json parsing failed: %s", warnPrefix, err)
-		return
+		return &fetchFailure{"profile", status}
 	}
 
 	if profile.Gender.Type == "FEMALE" {
@@ -380,16 +404,17 @@ func setPlayerDetails(player *player) {
 		player.Gender = 0
 	}
 
-	if profile.Faction.Type == "HORDE" {
-		player.FactionID = 67
-	} else {
-		player.FactionID = 469
-	}
+	player.FactionID = factionID(profile.Faction.Type)
 
 	player.RaceID = profile.Race.ID
 	player.ClassID = profile.CharacterClass.ID
 	player.SpecID = profile.ActiveSpec.ID
 	player.Guild = profile.Guild.Name
+	if profile.Guild.ID > 0 {
+		player.GuildID = profile.Guild.ID
+		player.GuildRealmID = profile.Guild.Realm.ID
+		player.GuildFactionID = factionID(profile.Guild.Faction.Type)
+	}
 	player.LastLogin = profile.LastLogin / 1000
 	profileID := getProfileIdentifier(player.Path)
 	if profileID != "" {
@@ -399,6 +424,7 @@ func setPlayerDetails(player *player) {
 		// within a region but that's fine as leaderboards are per region)
 		player.ProfileID = player.Path
 	}
+	return nil
 }
 
 func getProfileIdentifier(path string) string {
@@ -421,18 +447,22 @@ func getProfileIdentifier(path string) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-func getPlayerTalents(path string) playerTalents {
+// The HTTP status of the specializations request is returned with the talents (0 if no response)
+func getPlayerTalents(path string) (playerTalents, int) {
 	type Selected struct {
 		Talent keyedValue
 	}
 	type PvPTalent struct {
-		Selected Selected
+		Selected   Selected
+		SlotNumber int `json:"slot_number"`
 	}
 	type Loadout struct {
 		Active       bool            `json:"is_active"`
 		ClassTalents []loadoutTalent `json:"selected_class_talents"`
 		SpecTalents  []loadoutTalent `json:"selected_spec_talents"`
 		HeroTalents  []loadoutTalent `json:"selected_hero_talents"`
+		HeroTree     keyedValue      `json:"selected_hero_talent_tree"`
+		Code         string          `json:"talent_loadout_code"`
 	}
 	type Specialization struct {
 		Specialization keyedValue
@@ -441,29 +471,32 @@ func getPlayerTalents(path string) playerTalents {
 		ClassTalents   []loadoutTalent `json:"selected_class_talents"`
 		SpecTalents    []loadoutTalent `json:"selected_spec_talents"`
 		HeroTalents    []loadoutTalent `json:"selected_hero_talents"`
+		HeroTree       keyedValue      `json:"selected_hero_talent_tree"`
 	}
 	type Specializations struct {
 		Specializations      []Specialization
 		ActiveSpecialization keyedValue `json:"active_specialization"`
 	}
 	talentPath := path + "/specializations"
-	var talentJSON *[]byte = getProfile(region, talentPath)
+	talentJSON, status := getProfileWithStatus(region, talentPath)
 	if talentJSON == nil {
-		return playerTalents{}
+		return playerTalents{}, status
 	}
 	var specializations Specializations
 	err := safeUnmarshal(talentJSON, &specializations)
 	if err != nil {
 		logger.Printf("%s json parsing failed: %s", warnPrefix, err)
-		return playerTalents{}
+		return playerTalents{}, status
 	}
 
 	activeSpecID := specializations.ActiveSpecialization.ID
-	talents := make([]int, 0)
-	pvpTalents := make([]int, 0)
+	talents := make([]selectedTalent, 0)
+	pvpTalents := make([]selectedPvPTalent, 0)
 	var classTalents []loadoutTalent
 	var specTalents []loadoutTalent
 	var heroTalents []loadoutTalent
+	var heroTree keyedValue
+	var loadoutCode string
 	for _, spec := range specializations.Specializations {
 		if spec.Specialization.ID != activeSpecID {
 			continue
@@ -477,6 +510,8 @@ func getPlayerTalents(path string) playerTalents {
 			classTalents = loadout.ClassTalents
 			specTalents = stripHero(loadout.SpecTalents)
 			heroTalents = loadout.HeroTalents
+			heroTree = loadout.HeroTree
+			loadoutCode = loadout.Code
 			break
 		}
 		// Players not using loadouts have talents directly on the spec object
@@ -489,21 +524,24 @@ func getPlayerTalents(path string) playerTalents {
 		if len(spec.HeroTalents) > 0 {
 			heroTalents = spec.HeroTalents
 		}
+		if spec.HeroTree.ID > 0 {
+			heroTree = spec.HeroTree
+		}
 
-		talents = append(talents, talentIds(&classTalents)...)
-		talents = append(talents, talentIds(&specTalents)...)
-		talents = append(talents, talentIds(&heroTalents)...)
+		talents = append(talents, selectedTalents(&classTalents)...)
+		talents = append(talents, selectedTalents(&specTalents)...)
+		talents = append(talents, selectedTalents(&heroTalents)...)
 
 		for _, pvpTalent := range spec.PvPTalentSlots {
 			id := pvpTalent.Selected.Talent.ID
 			if id > 0 {
-				pvpTalents = append(pvpTalents, id)
+				pvpTalents = append(pvpTalents, selectedPvPTalent{id, pvpTalent.SlotNumber})
 			}
 		}
 		break
 	}
 
-	return playerTalents{talents, pvpTalents}
+	return playerTalents{talents, pvpTalents, heroTree, loadoutCode}, status
 }
 
 // Blizz includes hero talents in both the spec tree and hero tree
@@ -521,13 +559,14 @@ func stripHero(specTalents []loadoutTalent) []loadoutTalent {
 	return specTree
 }
 
-func talentIds(toAdd *[]loadoutTalent) []int {
-	talents := make([]int, 0)
+func selectedTalents(toAdd *[]loadoutTalent) []selectedTalent {
+	talents := make([]selectedTalent, 0)
 
 	for _, talent := range *toAdd {
 		id := talent.Tooltip.Talent.ID
 		if id > 0 {
-			talents = append(talents, id)
+			// Rank is omitted for some single rank talents
+			talents = append(talents, selectedTalent{id, talent.ID, max(talent.Rank, 1)})
 		}
 	}
 
@@ -600,12 +639,34 @@ func getPlayerItems(path string) items {
 		Spell       keyedValue
 		Description string
 	}
+	type LevelJSON struct {
+		Value int
+	}
+	type EnchantmentJSON struct {
+		DisplayString string     `json:"display_string"`
+		EnchantmentID int        `json:"enchantment_id"`
+		SourceItem    keyedValue `json:"source_item"`
+	}
+	type SocketJSON struct {
+		Item keyedValue
+	}
+	type SetJSON struct {
+		ItemSet keyedValue `json:"item_set"`
+	}
 	type ItemJSON struct {
-		Item    keyedValue
-		Slot    typedName
-		Name    string
-		Quality typedName
-		Spells  []SpellJSON
+		Item          keyedValue
+		Slot          typedName
+		Name          string
+		Quality       typedName
+		Spells        []SpellJSON
+		InventoryType typedName `json:"inventory_type"`
+		Level         LevelJSON
+		BonusList     []int             `json:"bonus_list"`
+		Enchantments  []EnchantmentJSON `json:"enchantments"`
+		Sockets       []SocketJSON      `json:"sockets"`
+		Set           SetJSON
+		LimitCategory string      `json:"limit_category"`
+		CraftedStats  []typedName `json:"modified_crafting_stat"`
 	}
 	type ItemsJSON struct {
 		EquippedItems []ItemJSON `json:"equipped_items"`
@@ -621,6 +682,7 @@ func getPlayerItems(path string) items {
 		return items{}
 	}
 	equippedItems := make(map[string]item)
+	equipment := make([]equippedItem, 0)
 	for _, i := range equipped.EquippedItems {
 		if i.Name == "" {
 			continue
@@ -632,6 +694,39 @@ func getPlayerItems(path string) items {
 			equippedItems["LEGENDARY_SPELL"] = item{spellID, name, i.Quality.Type}
 		}
 		equippedItems[i.Slot.Type] = item{i.Item.ID, i.Name, i.Quality.Type}
+
+		enchantIDs := make([]int, 0)
+		enchantNames := make([]string, 0)
+		for _, enchantment := range i.Enchantments {
+			enchantIDs = append(enchantIDs, enchantment.EnchantmentID)
+			enchantNames = append(enchantNames, enchantName(enchantment.DisplayString, enchantment.SourceItem.Name))
+		}
+		gemIDs := make([]int, 0)
+		for _, socket := range i.Sockets {
+			if socket.Item.ID > 0 {
+				gemIDs = append(gemIDs, socket.Item.ID)
+			}
+		}
+		craftedStats := make([]string, 0)
+		for _, stat := range i.CraftedStats {
+			craftedStats = append(craftedStats, stat.Type)
+		}
+		bonusIDs := i.BonusList
+		if bonusIDs == nil {
+			bonusIDs = make([]int, 0)
+		}
+		equipment = append(equipment, equippedItem{
+			Slot:          i.Slot.Type,
+			ItemID:        i.Item.ID,
+			InventoryType: i.InventoryType.Type,
+			Level:         i.Level.Value,
+			EnchantIDs:    enchantIDs,
+			EnchantNames:  enchantNames,
+			GemIDs:        gemIDs,
+			BonusIDs:      bonusIDs,
+			CraftedStats:  craftedStats,
+			SetID:         i.Set.ItemSet.ID,
+			Embellished:   strings.Contains(i.LimitCategory, "Embellished")})
 	}
 	return items{
 		Head:      equippedItems["HEAD"],
@@ -652,7 +747,48 @@ func getPlayerItems(path string) items {
 		Trinket2:  equippedItems["TRINKET_2"],
 		MainHand:  equippedItems["MAIN_HAND"],
 		OffHand:   equippedItems["OFF_HAND"],
-		Legendary: equippedItems["LEGENDARY_SPELL"]}
+		Legendary: equippedItems["LEGENDARY_SPELL"],
+		Equipment: equipment}
+}
+
+// Use the name of the enchant's source item when present, otherwise strip
+// the prefix and any embedded (quality) texture markup from the display string
+func enchantName(displayString string, sourceItemName string) string {
+	if sourceItemName != "" {
+		return sourceItemName
+	}
+	name := textureMarkup.ReplaceAllString(displayString, "")
+	name = strings.TrimPrefix(name, "Enchanted: ")
+	return strings.TrimSpace(name)
+}
+
+// Average item level as shown in game: shirt and tabard are ignored, empty
+// slots count as zero and a two-hander without an off hand counts twice
+func averageItemLevel(equipment []equippedItem) float64 {
+	const numSlots = 16
+	total := 0
+	hasOffHand := false
+	twoHanderLevel := 0
+	for _, e := range equipment {
+		if e.Slot == "SHIRT" || e.Slot == "TABARD" {
+			continue
+		}
+		if e.Slot == "OFF_HAND" {
+			hasOffHand = true
+		}
+		if e.Slot == "MAIN_HAND" && isTwoHanded(e.InventoryType) {
+			twoHanderLevel = e.Level
+		}
+		total += e.Level
+	}
+	if !hasOffHand {
+		total += twoHanderLevel
+	}
+	return math.Round(float64(total)/numSlots*100) / 100
+}
+
+func isTwoHanded(inventoryType string) bool {
+	return inventoryType == "TWOHWEAPON" || inventoryType == "RANGED" || inventoryType == "RANGEDRIGHT"
 }
 
 func squashItems(playersItems *cmap.ConcurrentMap[string, items]) map[int]item {
@@ -692,7 +828,7 @@ func addItem(items map[int]item, itemToAdd item) {
 	items[itemToAdd.ID] = itemToAdd
 }
 
-func getPlayerAchievements(path string, pvpAchievements map[int]bool) []int {
+func getPlayerAchievements(path string, pvpAchievements map[int]bool) []playerAchievement {
 	type AchievementJSON struct {
 		ID                 int
 		CompletedTimestamp int64 `json:"completed_timestamp"`
@@ -702,22 +838,22 @@ func getPlayerAchievements(path string, pvpAchievements map[int]bool) []int {
 	}
 	var achievedJSON *[]byte = getProfile(region, path+"/achievements")
 	if achievedJSON == nil {
-		return make([]int, 0)
+		return make([]playerAchievement, 0)
 	}
 	var achieved AchievedJSON
 	err := safeUnmarshal(achievedJSON, &achieved)
 	if err != nil {
 		logger.Printf("%s json parsing failed: %s", warnPrefix, err)
-		return make([]int, 0)
+		return make([]playerAchievement, 0)
 	}
-	achievedIDs := make([]int, 0)
+	achievements := make([]playerAchievement, 0)
 	for _, achievement := range achieved.Achievements {
 		id := achievement.ID
 		if pvpAchievements[id] && achievement.CompletedTimestamp > 0 {
-			achievedIDs = append(achievedIDs, id)
+			achievements = append(achievements, playerAchievement{id, achievement.CompletedTimestamp})
 		}
 	}
-	return achievedIDs
+	return achievements
 }
 
 func highestStat(a, b, c float64) int {
@@ -745,8 +881,10 @@ func safeUnmarshal(data *[]byte, v interface{}) error {
 }
 
 type playerTalents struct {
-	Talents    []int
-	PvPTalents []int
+	Talents     []selectedTalent
+	PvPTalents  []selectedPvPTalent
+	HeroTree    keyedValue
+	LoadoutCode string
 }
 
 type talentTooltip struct {
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* Character renders, refreshed only when they're likely to have changed */
+
+var characterMediaTTLSeconds int64 = int64(getEnvVarOrDefault("CHARACTER_MEDIA_TTL_HOURS", 168) * 60 * 60)
+var maxMediaFetchesPerRun int64 = int64(getEnvVarOrDefault("MAX_MEDIA_FETCHES_PER_RUN", 5000))
+
+// Shared by all regions so the limit applies to the run as a whole
+var mediaFetches atomic.Int64
+
+// Whether a player's media should be (re)fetched given what was stored when it was last fetched
+func needsMedia(current playerMedia, previous playerMedia, exists bool, now int64) bool {
+	if !exists {
+		return true
+	}
+	if current.RaceID != previous.RaceID || current.GearHash != previous.GearHash {
+		return true
+	}
+	return now-previous.FetchedAt > characterMediaTTLSeconds
+}
+
+// Identifies the equipped items (regardless of order) so gear changes can be detected
+func gearHash(equipment []equippedItem) string {
+	items := make([]string, 0, len(equipment))
+	for _, e := range equipment {
+		items = append(items, fmt.Sprintf("%s:%d", e.Slot, e.ItemID))
+	}
+	sort.Strings(items)
+	hash := sha256.Sum256([]byte(strings.Join(items, ",")))
+	return fmt.Sprintf("%x", hash)
+}
+
+// Retrieve the player's media if it has changed (or is missing) and the run's limit isn't reached
+func getPlayerMedia(player *player, equipment []equippedItem, previous map[string]playerMedia) *playerMedia {
+	media := playerMedia{RaceID: player.RaceID, GearHash: gearHash(equipment)}
+	existing, exists := previous[playerKey(player.RealmID, player.BlizzardID)]
+	if !needsMedia(media, existing, exists, time.Now().Unix()) {
+		return nil
+	}
+	if mediaFetches.Add(1) > maxMediaFetchesPerRun {
+		return nil
+	}
+
+	var mediaJSON *[]byte = getProfile(region, player.Path+"/character-media")
+	if mediaJSON == nil {
+		return nil
+	}
+	if !parseCharacterMedia(mediaJSON, &media) {
+		return nil
+	}
+	return &media
+}
+
+func parseCharacterMedia(data *[]byte, media *playerMedia) bool {
+	type AssetJSON struct {
+		Key   string
+		Value string
+	}
+	type MediaJSON struct {
+		Assets []AssetJSON
+	}
+	var mediaJSON MediaJSON
+	err := safeUnmarshal(data, &mediaJSON)
+	if err != nil {
+		logger.Printf("%s parsing character media failed: %s", warnPrefix, err)
+		return false
+	}
+
+	for _, asset := range mediaJSON.Assets {
+		switch asset.Key {
+		case "avatar":
+			media.Avatar = asset.Value
+		case "inset":
+			media.Inset = asset.Value
+		case "main-raw":
+			media.MainRaw = asset.Value
+		}
+	}
+	return media.Avatar != "" || media.Inset != "" || media.MainRaw != ""
+}
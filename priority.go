@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultBracketWeights string = "3v3=3,shuffle=3,2v2=2,rbg=1,blitz=1"
+
+var bracketWeights map[string]float64 = parseBracketWeights(
+	getEnvVarStringOrDefault("BRACKET_WEIGHTS", defaultBracketWeights))
+var priorityAgeWeight float64 = float64(getEnvVarOrDefault("PRIORITY_AGE_WEIGHT", 1))
+var priorityAgeCapSeconds int64 = int64(max(getEnvVarOrDefault("PRIORITY_AGE_CAP_HOURS", 72), 1) * 60 * 60)
+
+// Parses weights in the form "3v3=3,shuffle=3,2v2=2" skipping invalid entries
+func parseBracketWeights(weights string) map[string]float64 {
+	m := make(map[string]float64)
+	for _, pair := range strings.Split(weights, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), "=")
+		if len(parts) != 2 {
+			continue
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			logger.Printf("%s Invalid weight '%s' for bracket '%s'", warnPrefix, parts[1], parts[0])
+			continue
+		}
+		m[strings.ToLower(parts[0])] = weight
+	}
+	return m
+}
+
+func bracketWeight(bracket string) float64 {
+	name := bracket
+	if strings.HasPrefix(bracket, "solo_") {
+		name = "shuffle"
+	} else if strings.HasPrefix(bracket, "blitz_") {
+		name = "blitz"
+	}
+	weight, exists := bracketWeights[name]
+	if !exists {
+		return 1
+	}
+	return weight
+}
+
+// Order players so the most viewed (highest ranked in the most important
+// brackets) and those with the oldest data are refreshed first. A player's
+// rank score is their best weighted position across all leaderboards with
+// the age of their data (capped) adding up to priorityAgeWeight on top.
+func prioritizePlayers(
+	players map[string]*player,
+	leaderboards map[string][]leaderboardEntry,
+	lastUpdates map[string]int64,
+	now int64) []*player {
+	priorities := make(map[string]float64, len(players))
+	for bracket, entries := range leaderboards {
+		weight := bracketWeight(bracket)
+		size := float64(len(entries))
+		for i, entry := range entries {
+			rank := entry.Rank
+			if rank <= 0 {
+				rank = i + 1
+			}
+			// Percentile based so brackets of different sizes are comparable
+			score := weight * (1 - float64(rank-1)/size)
+			key := playerKey(entry.RealmID, entry.BlizzardID)
+			if score > priorities[key] {
+				priorities[key] = score
+			}
+		}
+	}
+
+	for key := range players {
+		age := priorityAgeCapSeconds
+		lastUpdate, exists := lastUpdates[key]
+		if exists {
+			age = min(now-lastUpdate, priorityAgeCapSeconds)
+		}
+		priorities[key] += priorityAgeWeight * float64(age) / float64(priorityAgeCapSeconds)
+	}
+
+	keys := make([]string, 0, len(players))
+	for key := range players {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if priorities[keys[i]] == priorities[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return priorities[keys[i]] > priorities[keys[j]]
+	})
+
+	var p []*player = make([]*player, 0, len(keys))
+	for _, key := range keys {
+		p = append(p, players[key])
+	}
+	return p
+}
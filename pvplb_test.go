@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	cmap "github.com/orcaman/concurrent-map/v2"
 )
@@ -53,6 +57,27 @@ func TestParseRealms(t *testing.T) {
 	t.Logf("Found and parsed %v realms", len(realms))
 }
 
+func TestParseConnectedRealm(t *testing.T) {
+	if id := parseConnectedRealmID("https://us.api.blizzard.com/data/wow/connected-realm/11?namespace=dynamic-us"); id != 11 {
+		t.Errorf("Expected connected realm 11 not %d", id)
+	}
+	data := []byte(`{"id": 11, "realms": [
+		{"id": 11, "name": "Tichondrius", "slug": "tichondrius", "category": "United States",
+			"locale": "enUS", "timezone": "America/Los_Angeles", "type": {"type": "NORMAL", "name": "Normal"}},
+		{"id": 1425, "name": "Drak'thul", "slug": "drakthul", "category": "United States",
+			"locale": "enUS", "timezone": "America/Chicago", "type": {"type": "RP", "name": "Roleplaying"}}]}`)
+	realms := parseConnectedRealm(&data)
+	if len(realms) != 2 {
+		t.Fatalf("Expected 2 realms but found %d", len(realms))
+	}
+	if realms[1].ConnectedRealmID != 11 || realms[1].Type != "RP" || realms[1].Timezone != "America/Chicago" {
+		t.Errorf("Incorrect realm %v", realms[1])
+	}
+	if realms[0].Locale != "enUS" || realms[0].Category != "United States" {
+		t.Errorf("Incorrect realm %v", realms[0])
+	}
+}
+
 func TestParseRaces(t *testing.T) {
 	var racesJSON *[]byte = getStatic(testRegion, "playable-race/index")
 	var races []race = parseRaces(racesJSON)
@@ -99,7 +124,7 @@ func TestGetBestPaths(t *testing.T) {
 		"talent-tree/6666/playable-specialization/10": "whatever",
 	}
 
-	bestPaths := getBestPaths(paths)
+	bestPaths := getBestPaths(paths, map[int]int{258: 795, 10: 5555})
 
 	if len(bestPaths) != 4 {
 		t.Errorf("Expected 4 best paths but found %v", len(bestPaths))
@@ -108,14 +133,15 @@ func TestGetBestPaths(t *testing.T) {
 	if bestPaths[0] != "talent-tree/3333/playable-specialization/11" {
 		t.Errorf("Incorrect path for element 0: %v", bestPaths[0])
 	}
-	if bestPaths[1] != "talent-tree/6666/playable-specialization/10" {
+	// Pinned to an older version
+	if bestPaths[1] != "talent-tree/5555/playable-specialization/10" {
 		t.Errorf("Incorrect path for element 1: %v", bestPaths[1])
 	}
 	if bestPaths[2] != "talent-tree/7777/playable-specialization/12" {
 		t.Errorf("Incorrect path for element 2: %v", bestPaths[2])
 	}
 
-	// Temporary hardcode of spriest due to Blizzard API bug
+	// Pinned spec not returned by the index
 	if bestPaths[3] != "talent-tree/795/playable-specialization/258" {
 		t.Errorf("Incorrect path for element 2: %v", bestPaths[3])
 	}
@@ -123,6 +149,29 @@ func TestGetBestPaths(t *testing.T) {
 	t.Logf("Found %v talent tree paths", len(bestPaths))
 }
 
+func TestParseTalentTreeOverrides(t *testing.T) {
+	overrides := parseTalentTreeOverrides("258=795, 62=800,bad,63=x")
+	if len(overrides) != 2 || overrides[258] != 795 || overrides[62] != 800 {
+		t.Errorf("Incorrect overrides %v", overrides)
+	}
+}
+
+func TestIsBrokenTalentTree(t *testing.T) {
+	prior := talentTreeVersion{NodeIDs: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	if isBrokenTalentTree(talentTreeVersion{NodeIDs: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 11}}, prior) {
+		t.Error("Tree with a replaced node flagged as broken")
+	}
+	if !isBrokenTalentTree(talentTreeVersion{NodeIDs: []int{1, 2, 3, 4, 5}}, prior) {
+		t.Error("Tree missing half its nodes not flagged as broken")
+	}
+	if !isBrokenTalentTree(talentTreeVersion{NodeIDs: []int{11, 12, 13, 14, 15, 16, 17, 18, 19, 20}}, prior) {
+		t.Error("Tree with a different layout not flagged as broken")
+	}
+	if isBrokenTalentTree(talentTreeVersion{NodeIDs: []int{1}}, talentTreeVersion{}) {
+		t.Error("Tree without a prior version flagged as broken")
+	}
+}
+
 func TestTalentTreePaths(t *testing.T) {
 	paths := getTalentTreePaths()
 
@@ -159,12 +208,332 @@ func TestExtractTalentTreePath(t *testing.T) {
 
 func TestGetTalentsFromTree(t *testing.T) {
 	path := "talent-tree/1000/playable-specialization/270"
-	talents := getTalentsFromTree(path)
+	talents, heroTrees, nodes := getTalentsFromTree(path)
 
 	if len(talents) == 0 {
 		t.Error("Getting talents from talent tree failed")
 	}
-	t.Logf("Found and parsed %v talents", len(talents))
+	if len(heroTrees) == 0 {
+		t.Error("Getting hero trees from talent tree failed")
+	}
+	talentNodes := make(map[int]bool)
+	for _, talent := range talents {
+		talentNodes[talent.NodeID] = true
+	}
+	if len(nodes) < len(talentNodes) {
+		t.Errorf("Found %d nodes but talents are on %d", len(nodes), len(talentNodes))
+	}
+	t.Logf("Found and parsed %v talents, %v hero trees and %v nodes", len(talents), len(heroTrees), len(nodes))
+}
+
+func TestParseTalentNodes(t *testing.T) {
+	classNodes := []TalentNodeJSON{{ID: 30, Unlocks: []int{40}}, {ID: 10}}
+	heroNodes := []TalentNodeJSON{{ID: 50, LockedBy: []int{20}}}
+	nodes := parseTalentNodes(6, classNodes, heroNodes)
+	expected := []int{10, 20, 30, 40, 50}
+	if len(nodes) != len(expected) {
+		t.Fatalf("Expected %d nodes but found %d", len(expected), len(nodes))
+	}
+	for i, id := range expected {
+		if nodes[i].NodeID != id || nodes[i].ClassID != 6 {
+			t.Errorf("Expected node %d at position %d but found %v", id, i, nodes[i])
+		}
+	}
+}
+
+// Decodes the active loadout string exported for a player against their class's full tree
+func TestValidatePlayerLoadout(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	p := player{Path: testPlayerPath}
+	setPlayerDetails(&p)
+	talents, _ := getPlayerTalents(testPlayerPath)
+	if talents.LoadoutCode == "" {
+		t.Fatal("Player has no loadout string")
+	}
+
+	paths := getTalentTreePaths()
+	treePrefix := ""
+	for _, path := range paths {
+		if strings.HasSuffix(path, fmt.Sprintf("/playable-specialization/%d", p.SpecID)) {
+			treePrefix = path[:strings.Index(path, "/playable-specialization/")]
+		}
+	}
+	nodeSet := make(map[int]bool)
+	maxRanks := make(map[int]int)
+	for _, path := range paths {
+		if treePrefix == "" || !strings.HasPrefix(path, treePrefix+"/") {
+			continue
+		}
+		treeTalents, _, nodes := getTalentsFromTree(path)
+		for _, node := range nodes {
+			nodeSet[node.NodeID] = true
+		}
+		for _, talent := range treeTalents {
+			maxRanks[talent.NodeID] = max(maxRanks[talent.NodeID], talent.MaxRank)
+		}
+	}
+	nodeIDs := make([]int, 0, len(nodeSet))
+	for id := range nodeSet {
+		nodeIDs = append(nodeIDs, id)
+	}
+	sort.Ints(nodeIDs)
+
+	decoded, err := decodeLoadout(talents.LoadoutCode, nodeIDs)
+	if err != nil {
+		t.Fatalf("Decoding loadout '%s' failed: %s", talents.LoadoutCode, err)
+	}
+	if decoded.SpecID != p.SpecID {
+		t.Errorf("Decoded spec %d but player is spec %d", decoded.SpecID, p.SpecID)
+	}
+	if !loadoutMatches(decoded, talents.Talents, maxRanks) {
+		t.Errorf("Loadout '%s' doesn't match the player's %d talents", talents.LoadoutCode, len(talents.Talents))
+	}
+}
+
+func TestParseTalentRanksAndChoices(t *testing.T) {
+	tooltip := func(talentID, spellID int) TooltipJSON {
+		return TooltipJSON{
+			Talent:       keyedValue{ID: talentID},
+			SpellTooltip: SpellTooltipJSON{Spell: keyedValue{ID: spellID}}}
+	}
+	nodes := []TalentNodeJSON{
+		{ID: 1, Ranks: []RankJSON{{Rank: 1, Tooltip: tooltip(10, 100)}, {Rank: 2, Tooltip: tooltip(10, 100)}}},
+		{ID: 2, Ranks: []RankJSON{{Rank: 1, Choice: []TooltipJSON{tooltip(20, 200), tooltip(21, 210)}}}},
+	}
+
+	talents := parseTalents(1, 2, "SPEC", []int{}, nodes)
+	if len(talents) != 3 {
+		t.Fatalf("Expected 3 talents but found %d", len(talents))
+	}
+	if talents[0].MaxRank != 2 || talents[0].ChoiceNode {
+		t.Errorf("Multi-rank talent parsed incorrectly: %v", talents[0])
+	}
+	if !talents[2].ChoiceNode || talents[2].ChoiceIndex != 1 || talents[2].MaxRank != 1 {
+		t.Errorf("Choice node talent parsed incorrectly: %v", talents[2])
+	}
+}
+
+// Builds a loadout string from (value, bit width) pairs
+func encodeLoadout(fields [][2]int) string {
+	bits := make([]int, 0)
+	for _, field := range fields {
+		for i := 0; i < field[1]; i++ {
+			bits = append(bits, (field[0]>>i)&1)
+		}
+	}
+	var encoded strings.Builder
+	for i := 0; i < len(bits); i += loadoutBitsPerChar {
+		value := 0
+		for j := 0; j < loadoutBitsPerChar && i+j < len(bits); j++ {
+			value |= bits[i+j] << j
+		}
+		encoded.WriteByte(loadoutChars[value])
+	}
+	return encoded.String()
+}
+
+func TestDecodeLoadout(t *testing.T) {
+	fields := [][2]int{{2, 8}, {270, 16}}
+	for i := 0; i < loadoutTreeHashBytes; i++ {
+		fields = append(fields, [2]int{0, 8})
+	}
+	fields = append(fields,
+		// Node 10: selected, purchased, fully ranked, not a choice
+		[2]int{1, 1}, [2]int{1, 1}, [2]int{0, 1}, [2]int{0, 1},
+		// Node 20: not selected
+		[2]int{0, 1},
+		// Node 30: selected, purchased, partially ranked (1), not a choice
+		[2]int{1, 1}, [2]int{1, 1}, [2]int{1, 1}, [2]int{1, 6}, [2]int{0, 1},
+		// Node 40: selected, purchased, fully ranked, second choice
+		[2]int{1, 1}, [2]int{1, 1}, [2]int{0, 1}, [2]int{1, 1}, [2]int{1, 2},
+		// Node 50: selected but granted
+		[2]int{1, 1}, [2]int{0, 1})
+	code := encodeLoadout(fields)
+
+	decoded, err := decodeLoadout(code, []int{10, 20, 30, 40, 50})
+	if err != nil {
+		t.Fatalf("Decoding loadout failed: %s", err)
+	}
+	if decoded.Version != 2 || decoded.SpecID != 270 {
+		t.Errorf("Incorrect header decoded: version %d spec %d", decoded.Version, decoded.SpecID)
+	}
+	if len(decoded.Nodes) != 4 {
+		t.Errorf("Expected 4 selected nodes but found %d", len(decoded.Nodes))
+	}
+	if node := decoded.Nodes[30]; node.FullyRanked || node.Ranks != 1 {
+		t.Errorf("Partially ranked node decoded incorrectly: %v", node)
+	}
+	if node := decoded.Nodes[40]; !node.ChoiceNode || node.ChoiceIndex != 1 {
+		t.Errorf("Choice node decoded incorrectly: %v", node)
+	}
+	if decoded.Nodes[50].Purchased {
+		t.Error("Granted node decoded as purchased")
+	}
+
+	talents := []selectedTalent{{1, 10, 2}, {3, 30, 1}, {4, 40, 1}}
+	maxRanks := map[int]int{10: 2, 30: 2, 40: 1}
+	if !loadoutMatches(decoded, talents, maxRanks) {
+		t.Error("Decoded loadout should match selected talents")
+	}
+	if loadoutMatches(decoded, talents[1:], maxRanks) {
+		t.Error("Decoded loadout should not match when a node is missing")
+	}
+
+	_, err = decodeLoadout(code[:10], []int{10, 20, 30, 40, 50})
+	if err == nil {
+		t.Error("Error should be returned when decoding a truncated loadout")
+	}
+}
+
+func TestClusterBuilds(t *testing.T) {
+	// Talents (ID, node, rank) keyed by node
+	build := func(talents ...selectedTalent) map[int]selectedTalent {
+		nodes := make(map[int]selectedTalent)
+		for _, talent := range talents {
+			nodes[talent.NodeID] = talent
+		}
+		return nodes
+	}
+	base := build(selectedTalent{1, 10, 1}, selectedTalent{2, 20, 2}, selectedTalent{3, 30, 1}, selectedTalent{4, 40, 1})
+	nearBase := build(selectedTalent{1, 10, 1}, selectedTalent{2, 20, 1}, selectedTalent{3, 30, 1}, selectedTalent{4, 40, 1})
+	different := build(selectedTalent{5, 50, 1}, selectedTalent{6, 60, 1}, selectedTalent{7, 70, 1}, selectedTalent{8, 80, 1})
+	builds := []playerBuild{
+		{Rating: 2000, Talents: base},
+		{Rating: 2200, Talents: build(selectedTalent{4, 40, 1}, selectedTalent{3, 30, 1}, selectedTalent{2, 20, 2}, selectedTalent{1, 10, 1})},
+		{Rating: 1800, Talents: nearBase},
+		{Rating: 2400, Talents: different},
+	}
+
+	clusters := clusterBuilds(builds, 1)
+	if len(clusters) != 2 {
+		t.Fatalf("Expected 2 clusters but found %d", len(clusters))
+	}
+	if clusters[0].Signature != buildSignature(base) {
+		t.Error("Most popular build not first")
+	}
+	if clusters[0].Players != 2 || clusters[0].ClusterPlayers != 3 {
+		t.Errorf("Expected 2 identical and 3 clustered players not %d and %d",
+			clusters[0].Players, clusters[0].ClusterPlayers)
+	}
+	if clusters[0].AvgRating != 2000 {
+		t.Errorf("Expected average rating of 2000 not %v", clusters[0].AvgRating)
+	}
+
+	clusters = clusterBuilds(builds, 0)
+	if len(clusters) != 3 {
+		t.Errorf("Expected 3 clusters of identical builds but found %d", len(clusters))
+	}
+}
+
+func TestNodeDistance(t *testing.T) {
+	a := map[int]selectedTalent{10: {1, 10, 1}, 20: {2, 20, 1}}
+	choiceSwapped := map[int]selectedTalent{10: {1, 10, 1}, 20: {3, 20, 1}}
+	if nodeDistance(a, choiceSwapped) != 1 {
+		t.Errorf("Swapping a choice node should count once not %d", nodeDistance(a, choiceSwapped))
+	}
+	nodeSwapped := map[int]selectedTalent{10: {1, 10, 1}, 30: {4, 30, 1}}
+	if nodeDistance(a, nodeSwapped) != 2 {
+		t.Errorf("Swapping a node for another should count twice not %d", nodeDistance(a, nodeSwapped))
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	data := []byte(`{"id": 251, "playable_class": {"name": "Death Knight", "id": 6}, "name": "Frost",
+		"role": {"type": "DAMAGE", "name": "Damage"},
+		"primary_stat_type": {"type": "STRENGTH", "name": "Strength"},
+		"gender_description": {"male": "He freezes", "female": "She freezes"},
+		"pvp_talents": [{"talent": {"name": "Dark Simulacrum", "id": 3512}}, {"talent": {"name": "Bitter Chill", "id": 5435}}],
+		"spec_talent_tree": {"key": {"href": "https://us.api.blizzard.com/data/wow/talent-tree/781/playable-specialization/251?namespace=static-us"}, "name": "Frost"}}`)
+	spec := parseSpec(&data)
+	if spec.ID != 251 || spec.ClassID != 6 || spec.Role != "DAMAGE" {
+		t.Errorf("Incorrect spec %v", spec)
+	}
+	if spec.Slug != "deathknight-frost" {
+		t.Errorf("Incorrect slug '%s'", spec.Slug)
+	}
+	if spec.PrimaryStat != "STRENGTH" || spec.MaleDescription != "He freezes" || spec.FemaleDescription != "She freezes" {
+		t.Errorf("Incorrect stat or descriptions %v", spec)
+	}
+	if spec.TalentTreeID != 781 {
+		t.Errorf("Expected talent tree 781 not %d", spec.TalentTreeID)
+	}
+	if len(spec.PvPTalentIDs) != 2 || spec.PvPTalentIDs[1] != 5435 {
+		t.Errorf("Incorrect PvP talents %v", spec.PvPTalentIDs)
+	}
+}
+
+// Selections are encoded for every node of the class tree, including those without
+// talents such as the hero tree selection node, so skipping them misaligns the rest
+func TestDecodeLoadoutFullTree(t *testing.T) {
+	fields := [][2]int{{2, 8}, {65, 16}}
+	for i := 0; i < loadoutTreeHashBytes; i++ {
+		fields = append(fields, [2]int{0, 8})
+	}
+	fields = append(fields,
+		// Node 100 (talent): selected, purchased, fully ranked
+		[2]int{1, 1}, [2]int{1, 1}, [2]int{0, 1}, [2]int{0, 1},
+		// Node 105 (hero tree selection, no talent): selected, purchased, second choice
+		[2]int{1, 1}, [2]int{1, 1}, [2]int{0, 1}, [2]int{1, 1}, [2]int{1, 2},
+		// Node 110 (talent): not selected
+		[2]int{0, 1},
+		// Node 120 (talent): selected, purchased, partially ranked (1)
+		[2]int{1, 1}, [2]int{1, 1}, [2]int{1, 1}, [2]int{1, 6}, [2]int{0, 1},
+		// Node 130 (talent): not selected
+		[2]int{0, 1})
+	code := encodeLoadout(fields)
+	talents := []selectedTalent{{1, 100, 1}, {2, 120, 1}}
+	maxRanks := map[int]int{100: 1, 110: 1, 120: 2, 130: 1}
+
+	decoded, err := decodeLoadout(code, []int{100, 105, 110, 120, 130})
+	if err != nil {
+		t.Fatalf("Decoding loadout failed: %s", err)
+	}
+	if node := decoded.Nodes[105]; !node.ChoiceNode || node.ChoiceIndex != 1 {
+		t.Errorf("Node without talents decoded incorrectly: %v", node)
+	}
+	if !loadoutMatches(decoded, talents, maxRanks) {
+		t.Error("Loadout decoded against the full tree should match selected talents")
+	}
+
+	decoded, err = decodeLoadout(code, []int{100, 110, 120, 130})
+	if err == nil && loadoutMatches(decoded, talents, maxRanks) {
+		t.Error("Loadout decoded against only nodes with talents should be misaligned")
+	}
+}
+
+func TestParsePvPTalent(t *testing.T) {
+	data := []byte(`{"id": 5, "spell": {"name": "Thorns", "id": 305497},
+		"playable_specialization": {"name": "Balance", "id": 102},
+		"description": "Sprout thorns |A:spell:a|afor 12 sec.", "unlock_player_level": 20,
+		"compatible_slots": [2, 3, 4], "overrides_spell": {"name": "Barkskin", "id": 22812}}`)
+	talent := parsePvPTalent(5, &data)
+	if talent.SpellID != 305497 || talent.SpecID != 102 || talent.Name != "Thorns" {
+		t.Errorf("Incorrect PvP talent %v", talent)
+	}
+	if talent.Description != "Sprout thorns for 12 sec." {
+		t.Errorf("Incorrect description '%s'", talent.Description)
+	}
+	if len(talent.CompatibleSlots) != 3 || talent.UnlockPlayerLevel != 20 || talent.OverridesSpellID != 22812 {
+		t.Errorf("Incorrect slot, level or override details %v", talent)
+	}
+}
+
+func TestParseItemDetails(t *testing.T) {
+	data := []byte(`{"id": 212445, "name": "Chain of the Burning Legion", "required_level": 80,
+		"item_class": {"name": "Armor", "id": 4}, "item_subclass": {"name": "Miscellaneous", "id": 0},
+		"inventory_type": {"type": "NECK", "name": "Neck"}}`)
+	details := parseItemDetails(&data)
+	if details.ID != 212445 || details.ClassID != 4 || details.SubclassID != 0 {
+		t.Errorf("Incorrect item details %v", details)
+	}
+	if details.InventoryType != "NECK" || details.RequiredLevel != 80 {
+		t.Errorf("Incorrect inventory type or required level %v", details)
+	}
+	if details.Icon != "" {
+		t.Error("Icon set without retrieving media")
+	}
 }
 
 func TestParsePvPTalents(t *testing.T) {
@@ -177,14 +546,72 @@ func TestParsePvPTalents(t *testing.T) {
 	t.Logf("Found and parsed %v PvP Talents", len(pvpTalents))
 }
 
-func TestParseAchievements(t *testing.T) {
+func TestParseAchievementCategory(t *testing.T) {
 	var achievementsJSON *[]byte = getStatic(testRegion, "achievement-category/15270")
-	var achievements []achievement = parseAchievements(achievementsJSON)
+	achievementIDs, _ := parseAchievementCategory(achievementsJSON, "Season")
 
-	if len(achievements) == 0 {
+	if len(achievementIDs) == 0 {
 		t.Error("Parsing achievements failed")
 	}
-	t.Logf("Found and parsed %v PvP achievements", len(achievements))
+	t.Logf("Found and parsed %v PvP achievements", len(achievementIDs))
+}
+
+func TestParseAchievementCatalog(t *testing.T) {
+	catalog, err := parseAchievementCatalog([]byte(defaultAchievementCatalog))
+	if err != nil {
+		t.Fatalf("Parsing default achievement catalog failed: %s", err)
+	}
+	if len(catalog.Categories) != 1 || !catalog.Categories[0].Tags.Seasonal {
+		t.Errorf("Incorrect catalog categories %v", catalog.Categories)
+	}
+	ids := 0
+	for _, a := range catalog.Achievements {
+		ids += len(a.IDs)
+		if a.Tags.Bracket == "" {
+			t.Errorf("Bracket tag NOT set for %v", a.IDs)
+		}
+	}
+	if ids != 17 {
+		t.Errorf("Expected 17 explicit achievements but found %d", ids)
+	}
+
+	data := []byte(`{"achievements": [{"id": 1, "name": "Gladiator: Season 1"}, {"id": 2, "name": "Duelist"}],
+		"subcategories": [{"id": 99, "name": "Arena"}]}`)
+	achievementIDs, subcategoryIDs := parseAchievementCategory(&data, "Season")
+	if len(achievementIDs) != 1 || achievementIDs[0] != 1 {
+		t.Errorf("Incorrect achievements %v", achievementIDs)
+	}
+	if len(subcategoryIDs) != 1 || subcategoryIDs[0] != 99 {
+		t.Errorf("Incorrect subcategories %v", subcategoryIDs)
+	}
+}
+
+func TestNewAchievements(t *testing.T) {
+	achievements := []achievement{{ID: 3}, {ID: 1}, {ID: 2}}
+	if len(newAchievements(achievements, map[int]bool{})) != 0 {
+		t.Error("Achievements reported as new when none were known")
+	}
+	added := newAchievements(achievements, map[int]bool{1: true})
+	if len(added) != 2 || added[0].ID != 2 || added[1].ID != 3 {
+		t.Errorf("Incorrect new achievements %v", added)
+	}
+}
+
+func TestParseLocalizedIndex(t *testing.T) {
+	single := []byte(`{"races": [{"id": 1, "name": "Human"}]}`)
+	localizations := parseLocalizedIndex(&single, "races")
+	if len(localizations) != 1 || localizations[0].Locale != defaultLocale {
+		t.Errorf("Single locale name not parsed as %s: %v", defaultLocale, localizations)
+	}
+
+	all := []byte(`{"races": [{"id": 1, "name": {"en_US": "Human", "de_DE": "Mensch", "ko_KR": "인간"}}]}`)
+	localizations = parseLocalizedIndex(&all, "races")
+	if len(localizations) != 3 {
+		t.Errorf("Expected 3 localizations but found %d", len(localizations))
+	}
+	if localizations[0].Locale != "de_DE" || localizations[0].Name != "Mensch" {
+		t.Errorf("Localizations not sorted by locale: %v", localizations)
+	}
 }
 
 func TestGetCurrentSeason(t *testing.T) {
@@ -255,31 +682,210 @@ func TestGetPlayersFromLeaderboards(t *testing.T) {
 	t.Logf("Found %d players from leaderboards", len(players))
 }
 
-func TestSliceSplitting(t *testing.T) {
-	max := 100
-	slice := make([]*player, 0)
+func TestSkipImportedPlayers(t *testing.T) {
+	players := []*player{
+		{Name: "a", RealmID: 1, BlizzardID: 1},
+		{Name: "b", RealmID: 1, BlizzardID: 2},
+		{Name: "c", RealmID: 2, BlizzardID: 1},
+	}
+	if len(skipImportedPlayers(players, map[string]bool{})) != len(players) {
+		t.Error("Players skipped without any imported")
+	}
+	remaining := skipImportedPlayers(players, map[string]bool{playerKey(1, 2): true, playerKey(2, 2): true})
+	if len(remaining) != 2 || remaining[0].Name != "a" || remaining[1].Name != "c" {
+		t.Errorf("Incorrect remaining players %v", remaining)
+	}
+}
+
+func TestIsResumableImportRun(t *testing.T) {
+	now := int64(1700000000)
+	if isResumableImportRun(0, now) {
+		t.Error("Resuming without a run")
+	}
+	if !isResumableImportRun(now-checkpointMaxAgeSeconds+1, now) {
+		t.Error("Recent run not resumed")
+	}
+	if isResumableImportRun(now-checkpointMaxAgeSeconds, now) {
+		t.Error("Run too old to resume not abandoned")
+	}
+}
+
+func TestPrioritizePlayers(t *testing.T) {
+	now := int64(1700000000)
+	leaderboards := map[string][]leaderboardEntry{
+		"2v2": {
+			{Name: "a", RealmID: 1, BlizzardID: 1, Rank: 1},
+			{Name: "b", RealmID: 1, BlizzardID: 2, Rank: 2},
+		},
+		"3v3": {
+			{Name: "c", RealmID: 1, BlizzardID: 3, Rank: 1},
+			{Name: "b", RealmID: 1, BlizzardID: 2, Rank: 2},
+			{Name: "d", RealmID: 1, BlizzardID: 4, Rank: 3},
+			{Name: "e", RealmID: 1, BlizzardID: 5, Rank: 3},
+		},
+	}
+	players := make(map[string]*player)
+	for _, entries := range leaderboards {
+		for _, entry := range entries {
+			players[playerKey(entry.RealmID, entry.BlizzardID)] = &player{Name: entry.Name}
+		}
+	}
+	// d and e are tied on rank but e has never been imported so gets the full age bonus
+	lastUpdates := map[string]int64{
+		playerKey(1, 1): now,
+		playerKey(1, 2): now,
+		playerKey(1, 3): now,
+		playerKey(1, 4): now,
+	}
+
+	prioritized := prioritizePlayers(players, leaderboards, lastUpdates, now)
+	expected := []string{"c", "e", "b", "a", "d"}
+	if len(prioritized) != len(expected) {
+		t.Fatalf("Returned %d players, but expected %d", len(prioritized), len(expected))
+	}
+	for i, name := range expected {
+		if prioritized[i].Name != name {
+			t.Errorf("Expected '%s' at position %d but found '%s'", name, i, prioritized[i].Name)
+		}
+	}
+}
+
+func TestParseBracketWeights(t *testing.T) {
+	weights := parseBracketWeights("3v3=3, shuffle=2.5,invalid,2v2=x")
+	if len(weights) != 2 {
+		t.Errorf("Expected 2 weights but found %d", len(weights))
+	}
+	if weights["shuffle"] != 2.5 {
+		t.Errorf("Expected shuffle weight of 2.5 not %v", weights["shuffle"])
+	}
+}
+
+func TestBatchResults(t *testing.T) {
+	max := 105
+	results := make(chan playerResult, max)
 	for i := 0; i < max; i++ {
-		slice = append(slice, &player{BlizzardID: i})
+		results <- playerResult{Player: &player{BlizzardID: i}}
+	}
+	close(results)
+
+	batches := make(chan []playerResult, max)
+	batchResults(results, batches, 10, time.Minute)
+
+	numBatches := 0
+	numResults := 0
+	for batch := range batches {
+		if len(batch) > 10 {
+			t.Errorf("Batch has %d elements - should not exceed 10", len(batch))
+		}
+		numBatches++
+		numResults += len(batch)
+	}
+	if numBatches != 11 {
+		t.Errorf("Returned %d batches, but expected 11", numBatches)
+	}
+	// The trailing partial batch must not be dropped
+	if numResults != max {
+		t.Errorf("Batched %d results, but expected %d", numResults, max)
 	}
+}
+
+func TestBatchResultsInterval(t *testing.T) {
+	results := make(chan playerResult)
+	batches := make(chan []playerResult, 1)
+	go batchResults(results, batches, 10, 10*time.Millisecond)
 
-	groups := split(slice, len(slice))
-	validateSplitting(t, groups, 1, max)
+	results <- playerResult{Player: &player{BlizzardID: 1}}
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 {
+			t.Errorf("Batch has %d elements, but expected 1", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Error("Partial batch not sent after interval elapsed")
+	}
+	close(results)
+}
 
-	groups = split(slice, 10)
-	validateSplitting(t, groups, len(slice)/10, 10)
+func TestInferTeams(t *testing.T) {
+	previous := map[string]snapshotEntry{
+		playerKey(1, 1): {10, 10, 0}, playerKey(1, 2): {20, 5, 0}, playerKey(2, 3): {0, 0, 0},
+		playerKey(1, 4): {50, 50, 1700000000}, playerKey(1, 5): {50, 50, 1700003600}, playerKey(1, 6): {100, 0, 0},
+	}
+	entries := []leaderboardEntry{
+		{RealmID: 1, BlizzardID: 1, Rating: 2400, SeasonWins: 18, SeasonLosses: 14},
+		{RealmID: 1, BlizzardID: 2, Rating: 2300, SeasonWins: 28, SeasonLosses: 9},
+		{RealmID: 2, BlizzardID: 3, Rating: 2200, SeasonWins: 8, SeasonLosses: 5},
+		{RealmID: 1, BlizzardID: 4, Rating: 1900, SeasonWins: 53, SeasonLosses: 60},
+		{RealmID: 1, BlizzardID: 5, Rating: 1800, SeasonWins: 52, SeasonLosses: 60},
+		// Too few games
+		{RealmID: 1, BlizzardID: 6, Rating: 1700, SeasonWins: 101, SeasonLosses: 0},
+		// Not in the previous snapshot
+		{RealmID: 1, BlizzardID: 7, Rating: 1600, SeasonWins: 8, SeasonLosses: 4},
+	}
+
+	teams := inferTeams(entries, previous, 3)
+	if len(teams) != 1 {
+		t.Fatalf("Expected 1 team but found %d: %v", len(teams), teams)
+	}
+	if len(teams[0].Members) != 3 || teams[0].Rating != 2300 || teams[0].Wins != 8 || teams[0].Losses != 4 {
+		t.Errorf("Incorrect team %v", teams[0])
+	}
+
+	teams = inferTeams(entries, previous, 2)
+	if len(teams) != 2 {
+		t.Fatalf("Expected 2 teams but found %d: %v", len(teams), teams)
+	}
+	// Players with a single candidate partner are most certain
+	if teams[0].Members[0] != playerKey(1, 5) || teams[0].Members[1] != playerKey(1, 4) {
+		t.Errorf("Incorrect most confident team %v", teams[0])
+	}
+	// Three players with identical deltas can't all be in a 2v2 team
+	if teams[1].Members[0] != playerKey(1, 1) || teams[1].Members[1] != playerKey(1, 2) {
+		t.Errorf("Incorrect team %v", teams[1])
+	}
+	if teams[1].Confidence >= teams[0].Confidence {
+		t.Errorf("Ambiguous team as confident as unambiguous team")
+	}
+
+	// Players last active days apart weren't playing together
+	previous[playerKey(1, 5)] = snapshotEntry{50, 50, 1700000000 + 3*24*60*60}
+	teams = inferTeams(entries, previous, 2)
+	if len(teams) != 1 || teams[0].Members[0] != playerKey(1, 1) {
+		t.Errorf("Expected only a team without players not active together but found %v", teams)
+	}
 }
 
-func validateSplitting(t *testing.T, groups [][]*player, expectedNumGroups, maxGroupSize int) {
-	if len(groups) != expectedNumGroups {
-		t.Errorf("Returned %d groups, but expected %d", len(groups), expectedNumGroups)
+func TestFactionID(t *testing.T) {
+	if factionID("HORDE") != 67 || factionID("ALLIANCE") != 469 {
+		t.Error("Incorrect faction IDs")
 	}
-	for _, group := range groups {
-		if len(group) > maxGroupSize {
-			t.Errorf("Group has %d elements - should not exceed %d", len(group), maxGroupSize)
+}
+
+func TestPlayerPath(t *testing.T) {
+	var cases = map[[2]string]string{
+		{"emerald-dream", "Exuperjun"}: "emerald-dream/exuperjun",
+		{"kazzak", "Ærïs"}:             "kazzak/%C3%A6r%C3%AFs",
+		{"아즈샤라", "해골기사"}:               "%EC%95%84%EC%A6%88%EC%83%A4%EB%9D%BC/%ED%95%B4%EA%B3%A8%EA%B8%B0%EC%82%AC",
+		{"shadowmoon", "暗影月"}:          "shadowmoon/%E6%9A%97%E5%BD%B1%E6%9C%88",
+	}
+
+	for input, expected := range cases {
+		actual := playerPath(input[0], input[1])
+		if actual != expected {
+			t.Errorf("Returned '%s' for '%v' but expected '%s'", actual, input, expected)
 		}
 	}
 }
 
+func TestLocaleForRegion(t *testing.T) {
+	if localeForRegion("kr") != "ko_KR" {
+		t.Errorf("Expected ko_KR for KR not %s", localeForRegion("kr"))
+	}
+	if localeForRegion("US") != defaultLocale {
+		t.Errorf("Expected %s for US not %s", defaultLocale, localeForRegion("US"))
+	}
+}
+
 func TestGetPlayerProfileDetails(t *testing.T) {
 	player := player{Path: testPlayerPath}
 	setPlayerDetails(&player)
@@ -299,14 +905,25 @@ func TestGetPlayerProfileDetails(t *testing.T) {
 	if player.LastLogin == 0 {
 		t.Error("Last login time NOT set")
 	}
+	if player.Guild != "" && (player.GuildID == 0 || player.GuildRealmID == 0) {
+		t.Error("Guild IDs NOT set")
+	}
 	t.Logf("Last login %d", player.LastLogin)
 }
 
 func TestGetPlayerTalents(t *testing.T) {
-	talents := getPlayerTalents(testPlayerPath)
+	talents, _ := getPlayerTalents(testPlayerPath)
 	if len(talents.Talents) == 0 || len(talents.PvPTalents) == 0 {
 		t.Error("Getting player talents failed")
 	}
+	if talents.HeroTree.ID == 0 {
+		t.Error("Getting player hero tree failed")
+	}
+	for _, pvpTalent := range talents.PvPTalents {
+		if pvpTalent.Slot == 0 {
+			t.Errorf("Slot NOT set for PvP talent %d", pvpTalent.ID)
+		}
+	}
 	t.Logf("Found %d talents and %d PvP talents", len(talents.Talents), len(talents.PvPTalents))
 }
 
@@ -375,6 +992,133 @@ func TestSquashPlayerItems(t *testing.T) {
 	t.Logf("Squashed items: %v", squashedItems)
 }
 
+func TestAverageItemLevel(t *testing.T) {
+	equipment := []equippedItem{
+		{Slot: "HEAD", Level: 640},
+		{Slot: "SHIRT", Level: 1},
+		{Slot: "MAIN_HAND", Level: 650, InventoryType: "TWOHWEAPON"},
+	}
+	// Two-hander counts twice and the shirt is ignored
+	expected := float64(640+650+650) / 16
+	actual := averageItemLevel(equipment)
+	if math.Abs(actual-expected) > 0.01 {
+		t.Errorf("Expected average item level of %.2f not %.2f", expected, actual)
+	}
+
+	equipment = append(equipment, equippedItem{Slot: "OFF_HAND", Level: 630})
+	expected = float64(640+650+630) / 16
+	actual = averageItemLevel(equipment)
+	if math.Abs(actual-expected) > 0.01 {
+		t.Errorf("Expected average item level of %.2f not %.2f", expected, actual)
+	}
+}
+
+func TestNeedsMedia(t *testing.T) {
+	now := time.Now().Unix()
+	gear := gearHash([]equippedItem{{Slot: "HEAD", ItemID: 1}, {Slot: "CHEST", ItemID: 2}})
+	if gear != gearHash([]equippedItem{{Slot: "CHEST", ItemID: 2}, {Slot: "HEAD", ItemID: 1}}) {
+		t.Error("Gear hash depends on item order")
+	}
+	current := playerMedia{RaceID: 1, GearHash: gear}
+	fresh := playerMedia{RaceID: 1, GearHash: gear, FetchedAt: now - 60}
+
+	if !needsMedia(current, playerMedia{}, false, now) {
+		t.Error("Media not needed for player without media")
+	}
+	if needsMedia(current, fresh, true, now) {
+		t.Error("Media needed for unchanged player")
+	}
+	if !needsMedia(playerMedia{RaceID: 2, GearHash: gear}, fresh, true, now) {
+		t.Error("Media not needed after race change")
+	}
+	if !needsMedia(playerMedia{RaceID: 1, GearHash: "changed"}, fresh, true, now) {
+		t.Error("Media not needed after gear change")
+	}
+	expired := playerMedia{RaceID: 1, GearHash: gear, FetchedAt: now - characterMediaTTLSeconds - 1}
+	if !needsMedia(current, expired, true, now) {
+		t.Error("Media not needed after TTL")
+	}
+}
+
+func TestEnchantName(t *testing.T) {
+	var cases = map[[2]string]string{
+		{"Enchanted: Radiant Mastery |A:Professions-ChatIcon-Quality-Tier3:20:20|a", ""}: "Radiant Mastery",
+		{"Enchanted: Radiant Mastery", "Enchant Ring - Radiant Mastery"}:                 "Enchant Ring - Radiant Mastery",
+		{"+10 Stamina", ""}: "+10 Stamina",
+	}
+
+	for input, expected := range cases {
+		actual := enchantName(input[0], input[1])
+		if actual != expected {
+			t.Errorf("Returned '%s' for '%v' but expected '%s'", actual, input, expected)
+		}
+	}
+}
+
+func TestValidateRun(t *testing.T) {
+	leaderboards := map[string][]leaderboardEntry{
+		"2v2": make([]leaderboardEntry, 100),
+		"3v3": make([]leaderboardEntry, 40),
+		"rbg": make([]leaderboardEntry, 10),
+	}
+	previousSizes := map[string]int{"2v2": 100, "3v3": 100}
+	m := runMetrics{Players: 100, ProfileFailures: 5, PlayersImported: 95, Talents: 95 * 30, ZeroStatsPlayers: 2}
+
+	checks := validateRun(leaderboards, previousSizes, m)
+	if len(checks) != 5 {
+		t.Fatalf("Expected 5 checks but found %d", len(checks))
+	}
+	blocked := blockedBrackets(leaderboards, checks)
+	if len(blocked) != 1 || !blocked["3v3"] {
+		t.Errorf("Expected only 3v3 blocked not %v", blocked)
+	}
+
+	m.ProfileFailures = 50
+	blocked = blockedBrackets(leaderboards, validateRun(leaderboards, previousSizes, m))
+	if len(blocked) != len(leaderboards) {
+		t.Errorf("Expected all brackets blocked not %v", blocked)
+	}
+}
+
+func TestStatDistribution(t *testing.T) {
+	values := []float64{50, 10, 40, 20, 30, 60, 70, 80, 90, 100}
+	weights := []float64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+	d := distribution(values, weights)
+	if d.Players != 10 || d.Mean != 55 || d.Median != 50 || d.P10 != 10 || d.P90 != 90 {
+		t.Errorf("Incorrect distribution %v", d)
+	}
+
+	// The heavily weighted value dominates
+	d = distribution([]float64{10, 20, 30}, []float64{1, 1, 8})
+	if d.Median != 30 || d.Mean != 27 || d.P10 != 10 {
+		t.Errorf("Incorrect weighted distribution %v", d)
+	}
+
+	if !isIncompleteStats([]float64{0, 0, 0, 0, 0}) || isIncompleteStats([]float64{0, 0, 1, 0, 0}) {
+		t.Error("Incomplete stats NOT identified")
+	}
+}
+
+func TestBracketFamily(t *testing.T) {
+	sql := bracketFamily("l.bracket")
+	if !strings.Contains(sql, `l.bracket LIKE 'solo\_%' THEN 'shuffle'`) || strings.Contains(sql, "%%") {
+		t.Errorf("Incorrect bracket family SQL: %s", sql)
+	}
+}
+
+func TestParseRatingBands(t *testing.T) {
+	bands := parseRatingBands("2400, 0,invalid,1800")
+	expected := []int{0, 1800, 2400}
+	if len(bands) != len(expected) {
+		t.Fatalf("Expected %d bands but found %d", len(expected), len(bands))
+	}
+	for i, band := range expected {
+		if bands[i] != band {
+			t.Errorf("Expected band %d at position %d not %d", band, i, bands[i])
+		}
+	}
+}
+
 func TestGetPlayerAchievements(t *testing.T) {
 	achieved := getPlayerAchievements(testPlayerPath, map[int]bool{2092: true, 13989: true})
 	if len(achieved) == 0 {
@@ -383,6 +1127,87 @@ func TestGetPlayerAchievements(t *testing.T) {
 	t.Logf("Found achievements: %v", achieved)
 }
 
+func TestFilterAccolades(t *testing.T) {
+	owned := []keyedValue{
+		{Name: "Crimson Gladiator", ID: 1},
+		{Name: "Elite", ID: 2},
+		{Name: "Loremaster", ID: 3},
+		{Name: "Legend", ID: 0},
+	}
+	keywords := parseKeywords("Gladiator, Legend,,Elite")
+	accolades := filterAccolades(accoladeTitle, owned, func(o keyedValue) bool {
+		return containsKeyword(o.Name, keywords)
+	})
+	if len(accolades) != 2 {
+		t.Fatalf("Expected 2 accolades but found %d", len(accolades))
+	}
+	if accolades[0].ID != 1 || accolades[1].ID != 2 || accolades[0].Kind != accoladeTitle {
+		t.Errorf("Incorrect accolades %v", accolades)
+	}
+	if accolades[0].AchievedAt != 0 {
+		t.Error("Title has an achieved time")
+	}
+}
+
+func TestParseTitleAchievements(t *testing.T) {
+	data := []byte(`{"id": 42, "name": "Gladiator", "gender_name": {"male": "Gladiator", "female": "Gladiator"},
+		"source": {"type": {"type": "ACHIEVEMENT", "name": "Achievement"},
+		"achievements": [{"name": "Gladiator", "id": 2091}]}}`)
+	achievementIDs := parseTitleAchievements(&data)
+	if len(achievementIDs) != 1 || achievementIDs[0] != 2091 {
+		t.Errorf("Incorrect title achievements %v", achievementIDs)
+	}
+	data = []byte(`{"id": 1, "name": "Private"}`)
+	if len(parseTitleAchievements(&data)) != 0 {
+		t.Error("Title without a source has achievements")
+	}
+}
+
+func TestTopFailures(t *testing.T) {
+	notFound := fetchFailure{"profile", 404}
+	unavailable := fetchFailure{"profile", 503}
+	noResponse := fetchFailure{"profile", 0}
+	counts := map[fetchFailure]int{notFound: 7, unavailable: 2, noResponse: 2}
+	top := topFailures(counts, 2)
+	if len(top) != 2 {
+		t.Fatalf("Expected 2 failures but found %d", len(top))
+	}
+	if top[0] != notFound || top[1] != unavailable {
+		t.Errorf("Incorrect top failures %v", top)
+	}
+	if notFound.transient() || !unavailable.transient() || !noResponse.transient() {
+		t.Error("Incorrect transient failures")
+	}
+}
+
+func TestDeferTransientFailures(t *testing.T) {
+	transient := &player{BlizzardID: 1}
+	notFound := &player{BlizzardID: 2}
+	found := &player{BlizzardID: 3, ClassID: 1}
+	results := []playerResult{
+		{Player: transient, Failure: &fetchFailure{"talents", 503}},
+		{Player: notFound, Failure: &fetchFailure{"profile", 404}},
+		{Player: found},
+	}
+
+	remaining := deferTransientFailures(results)
+	if len(remaining) != 2 || remaining[0].Player != notFound || remaining[1].Player != found {
+		t.Errorf("Incorrect results remaining after deferring transient failures %v", remaining)
+	}
+	retries := takeTransientFailures()
+	if len(retries) != 1 || retries[0] != transient {
+		t.Errorf("Incorrect players to retry %v", retries)
+	}
+
+	// Failures when retrying are final so recorded (once) rather than deferred again
+	setRetryingFailures(true)
+	defer setRetryingFailures(false)
+	remaining = deferTransientFailures(results[:1])
+	if len(remaining) != 1 || getFailedRetries() != 1 || len(takeTransientFailures()) != 0 {
+		t.Error("Failed retry deferred again")
+	}
+}
+
 func TestDetermineAlt(t *testing.T) {
 	var altPlayerPath = "emerald-dream/exupery"
 	altID := getProfileIdentifier(altPlayerPath)
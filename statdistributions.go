@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sort"
+)
+
+/* Distributions of secondary stats per spec */
+
+var statRatingWeighted bool = getEnvVarOrDefault("STAT_RATING_WEIGHTED", 0) == 1
+
+var secondaryStats = []string{"critical_strike", "haste", "mastery", "versatility", "leech"}
+
+// statSample : a leaderboard player's secondary stats (in the order of secondaryStats)
+type statSample struct {
+	Bracket string
+	SpecID  int
+	Rating  int
+	Values  []float64
+}
+
+// statDistribution : summary of a stat's values across players
+type statDistribution struct {
+	Players int
+	Mean    float64
+	Median  float64
+	P10     float64
+	P25     float64
+	P75     float64
+	P90     float64
+}
+
+// Players whose stats couldn't be fully retrieved have every secondary stat as zero
+func isIncompleteStats(values []float64) bool {
+	for _, v := range values {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Mean and (nearest rank) percentiles of values, each counted in proportion to its weight
+func distribution(values []float64, weights []float64) statDistribution {
+	type weighted struct {
+		value  float64
+		weight float64
+	}
+	sorted := make([]weighted, 0, len(values))
+	total := 0.0
+	sum := 0.0
+	for i, v := range values {
+		sorted = append(sorted, weighted{v, weights[i]})
+		total += weights[i]
+		sum += v * weights[i]
+	}
+	if total <= 0 {
+		return statDistribution{Players: len(values)}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].value < sorted[j].value
+	})
+
+	percentile := func(p float64) float64 {
+		threshold := total * p / 100
+		cumulative := 0.0
+		for _, w := range sorted {
+			cumulative += w.weight
+			if cumulative >= threshold {
+				return w.value
+			}
+		}
+		return sorted[len(sorted)-1].value
+	}
+	return statDistribution{
+		len(values),
+		sum / total,
+		percentile(50),
+		percentile(10),
+		percentile(25),
+		percentile(75),
+		percentile(90)}
+}
+
+// Write the distribution of each secondary stat per bracket and spec of the current region
+func updateStatDistributions() {
+	type groupKey struct {
+		Bracket string
+		SpecID  int
+	}
+	groups := make(map[groupKey][]statSample)
+	excluded := 0
+	for _, sample := range getStatSamples() {
+		if isIncompleteStats(sample.Values) {
+			excluded++
+			continue
+		}
+		key := groupKey{sample.Bracket, sample.SpecID}
+		groups[key] = append(groups[key], sample)
+	}
+	logger.Printf("Excluded %d %s players with incomplete stats", excluded, region)
+
+	args := make([][]interface{}, 0)
+	for key, samples := range groups {
+		weights := make([]float64, 0, len(samples))
+		for _, sample := range samples {
+			weight := 1.0
+			if statRatingWeighted {
+				weight = float64(sample.Rating)
+			}
+			weights = append(weights, weight)
+		}
+		for i, stat := range secondaryStats {
+			values := make([]float64, 0, len(samples))
+			for _, sample := range samples {
+				values = append(values, sample.Values[i])
+			}
+			d := distribution(values, weights)
+			args = append(args, []interface{}{region, key.Bracket, key.SpecID, stat, d.Players,
+				d.Mean, d.Median, d.P10, d.P25, d.P75, d.P90, statRatingWeighted})
+		}
+	}
+	addStatDistributions(args)
+}
@@ -9,31 +9,46 @@ import (
 	"sync"
 )
 
-const pvpFeatsOfStrengthCategory int = 15270
+var realmRegions = []string{"EU", "US", "KR", "TW"}
 
-var achievementIDs = []int{
-	// 2v2
-	399, 400, 401, 1159,
-	// 3v3
-	402, 403, 405, 1160, 5266, 5267, 2091,
-	// RBG achievements
-	5341, 5355, 5343, 5356, 6942, 6941,
-}
+var connectedRealmPattern = regexp.MustCompile(`connected-realm/([0-9]+)`)
 
-var realmRegions = []string{"EU", "US", "KR", "TW"}
+var itemDetailsTTLHours int = getEnvVarOrDefault("ITEM_DETAILS_TTL_HOURS", 24*7)
 
-func importStaticData() {
-	logger.Println("Beginning import of static data")
-	for _, r := range realmRegions {
+// Items already considered for a details refresh during this run
+var checkedItems sync.Map
+
+// Items seen by the DB writers whose details are retrieved once the writers finish
+var queuedItems []int
+var queuedItemsLock sync.Mutex
+
+func importStaticRealms() {
+	imported := make(map[string]bool)
+	for _, r := range append(realmRegions, regions...) {
+		if imported[r] {
+			continue
+		}
 		importRealms(r)
+		imported[r] = true
 	}
+}
+
+func importStaticData() {
+	logger.Println("Beginning import of static data")
+	importStaticRealms()
 	importRaces()
 	importClasses()
-	importSpecs()
+	specs := importSpecs()
 	importTalents()
 	importPvPTalents()
-	importAchievements()
+	addSpecPvPTalents(&specs)
+	newAchievements := importAchievements()
+	importPvPSeasons()
+	if importAllLocales {
+		importLocalizations()
+	}
 
+	reportNewAchievements(newAchievements)
 	logger.Println("Static data import complete")
 }
 
@@ -51,12 +66,91 @@ func parseRealms(data *[]byte) []realm {
 }
 
 func importRealms(region string) {
-	var realmJSON *[]byte = getDynamic(region, "realm/index")
+	var realmJSON *[]byte = getDynamicInRegionLocale(region, "realm/index")
 	var realms []realm = parseRealms(realmJSON)
 	logger.Printf("Found %d %s realms", len(realms), region)
+
+	connected := getConnectedRealms(region)
+	logger.Printf("Found %d %s realms in connected realms", len(connected), region)
+	for i, r := range realms {
+		if details, exists := connected[r.ID]; exists {
+			realms[i] = details
+		}
+	}
 	addRealms(&realms, region)
 }
 
+// Realms (with their grouping and metadata) of every connected realm in the region
+func getConnectedRealms(region string) map[int]realm {
+	type ConnectedRealmsJSON struct {
+		ConnectedRealms []key `json:"connected_realms"`
+	}
+	realms := make(map[int]realm)
+	var indexJSON *[]byte = getDynamicInRegionLocale(region, "connected-realm/index")
+	var index ConnectedRealmsJSON
+	err := safeUnmarshal(indexJSON, &index)
+	if err != nil {
+		logger.Printf("%s parsing connected realms failed: %s", warnPrefix, err)
+		return realms
+	}
+
+	ids := make([]int, 0, len(index.ConnectedRealms))
+	for _, connectedRealm := range index.ConnectedRealms {
+		if id := parseConnectedRealmID(connectedRealm.Href); id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	var mutex sync.Mutex
+	fetchAll(ids, func(id int) {
+		var connectedJSON *[]byte = getDynamicInRegionLocale(region, fmt.Sprintf("connected-realm/%d", id))
+		parsed := parseConnectedRealm(connectedJSON)
+		mutex.Lock()
+		for _, r := range parsed {
+			realms[r.ID] = r
+		}
+		mutex.Unlock()
+	})
+	return realms
+}
+
+func parseConnectedRealmID(href string) int {
+	match := connectedRealmPattern.FindStringSubmatch(href)
+	if match == nil {
+		return 0
+	}
+	id, _ := strconv.Atoi(match[1])
+	return id
+}
+
+func parseConnectedRealm(data *[]byte) []realm {
+	type RealmJSON struct {
+		ID       int
+		Slug     string
+		Name     string
+		Category string
+		Locale   string
+		Timezone string
+		Type     typedName
+	}
+	type ConnectedRealmJSON struct {
+		ID     int
+		Realms []RealmJSON
+	}
+	var connectedRealm ConnectedRealmJSON
+	err := safeUnmarshal(data, &connectedRealm)
+	if err != nil {
+		logger.Printf("%s parsing connected realm failed: %s", warnPrefix, err)
+		return []realm{}
+	}
+
+	realms := make([]realm, 0, len(connectedRealm.Realms))
+	for _, r := range connectedRealm.Realms {
+		realms = append(realms, realm{r.ID, r.Slug, r.Name, connectedRealm.ID,
+			r.Type.Type, r.Timezone, r.Locale, r.Category})
+	}
+	return realms
+}
+
 func parseRaces(data *[]byte) []race {
 	type Races struct {
 		Races []race
@@ -97,11 +191,12 @@ func importClasses() {
 	addClasses(&classes)
 }
 
-func importSpecs() {
+func importSpecs() []spec {
 	var specsJSON *[]byte = getStatic(region, "playable-specialization/index")
 	var specs []spec = parseSpecs(specsJSON)
 	logger.Printf("Found %d specializations", len(specs))
 	addSpecs(&specs)
+	return specs
 }
 
 func parseSpecs(data *[]byte) []spec {
@@ -137,40 +232,94 @@ func getFullSpecInfo(specIDs []int) []spec {
 }
 
 func getSpec(ch chan spec, specID int) {
-	type RoleJSON struct {
-		Role string `json:"type"`
-	}
-	type SpecJSON struct {
-		ID            int
-		PlayableClass keyedValue `json:"playable_class"`
-		Name          string
-		Media         keyedValue
-		Role          RoleJSON
-		PvpTalents    []interface{} `json:"pvp_talents"`
-		TalentTree    keyedValue    `json:"spec_talent_tree"`
-	}
 	var path string = fmt.Sprintf("playable-specialization/%d", specID)
 	var icon = getIcon(region, path)
 	var specJSON *[]byte = getStatic(region, path)
+	s := parseSpec(specJSON)
+	s.Icon = icon
+	ch <- s
+}
+
+func parseSpec(data *[]byte) spec {
+	type TypeJSON struct {
+		Type string
+	}
+	type GenderDescriptionJSON struct {
+		Male   string
+		Female string
+	}
+	type PvPTalentJSON struct {
+		Talent keyedValue
+	}
+	type SpecJSON struct {
+		ID                int
+		PlayableClass     keyedValue `json:"playable_class"`
+		Name              string
+		Media             keyedValue
+		Role              TypeJSON
+		PrimaryStatType   TypeJSON              `json:"primary_stat_type"`
+		GenderDescription GenderDescriptionJSON `json:"gender_description"`
+		PvpTalents        []PvPTalentJSON       `json:"pvp_talents"`
+		TalentTree        keyedValue            `json:"spec_talent_tree"`
+	}
 	var s SpecJSON
-	safeUnmarshal(specJSON, &s)
-	ch <- spec{
+	safeUnmarshal(data, &s)
+
+	talentTreeID := 0
+	if s.TalentTree.Key.Href != "" {
+		_, talentTreeID, _ = parseTalentTreeVersion(parseSpecTalentTreePath(s.TalentTree.Key.Href))
+	}
+	pvpTalentIDs := make([]int, 0, len(s.PvpTalents))
+	for _, pvpTalent := range s.PvpTalents {
+		if pvpTalent.Talent.ID > 0 {
+			pvpTalentIDs = append(pvpTalentIDs, pvpTalent.Talent.ID)
+		}
+	}
+	return spec{
 		s.ID,
 		s.PlayableClass.ID,
 		s.Name,
-		s.Role.Role,
-		icon}
+		s.Role.Type,
+		"",
+		specSlug(s.PlayableClass.Name, s.Name),
+		s.PrimaryStatType.Type,
+		s.GenderDescription.Male,
+		s.GenderDescription.Female,
+		talentTreeID,
+		pvpTalentIDs}
+}
+
+// Class and spec names as they appear in solo bracket keys (e.g. "deathknight-frost")
+func specSlug(className string, specName string) string {
+	classSlug := strings.ReplaceAll(strings.ToLower(className), " ", "")
+	slug := strings.ReplaceAll(strings.ToLower(specName), " ", "")
+	return classSlug + "-" + slug
 }
 
 func importTalents() {
 	var paths = getTalentTreePaths()
+	lastGood := getLastGoodTalentTrees()
 	talentMap := make(map[int]talent)
+	heroTreeMap := make(map[int]heroTree)
+	nodeMap := make(map[talentNode]bool)
 	for _, path := range paths {
-		treeTalents := getTalentsFromTree(path)
+		treeTalents, heroTrees, treeNodes := getValidatedTalents(path, lastGood)
 		for _, talent := range treeTalents {
 			talentMap[talent.ID] = talent
 		}
+		for _, tree := range heroTrees {
+			heroTreeMap[tree.ID] = tree
+		}
+		for _, node := range treeNodes {
+			nodeMap[node] = true
+		}
+	}
+	importHeroTrees(heroTreeMap)
+	nodes := make([]talentNode, 0, len(nodeMap))
+	for node := range nodeMap {
+		nodes = append(nodes, node)
 	}
+	addTalentNodes(&nodes)
 
 	talents := make([]talent, len(talentMap))
 	var waitGroup sync.WaitGroup
@@ -179,20 +328,8 @@ func importTalents() {
 		waitGroup.Add(1)
 		go func(i int, tal talent) {
 			defer waitGroup.Done()
-			icon := getIcon(region, fmt.Sprintf("spell/%d", tal.SpellID))
-			talentWithIcon := talent{
-				tal.ID,
-				tal.SpellID,
-				tal.ClassID,
-				tal.SpecID,
-				tal.Name,
-				icon,
-				tal.NodeID,
-				tal.Row,
-				tal.Col,
-				tal.Cat,
-				tal.HeroSpecs}
-			talents[i] = talentWithIcon
+			tal.Icon = getIcon(region, fmt.Sprintf("spell/%d", tal.SpellID))
+			talents[i] = tal
 		}(i, t)
 		i++
 	}
@@ -200,6 +337,24 @@ func importTalents() {
 	addTalents(&talents)
 }
 
+func importHeroTrees(heroTreeMap map[int]heroTree) {
+	heroTrees := make([]heroTree, 0, len(heroTreeMap))
+	var mutex sync.Mutex
+	ids := make([]int, 0, len(heroTreeMap))
+	for id := range heroTreeMap {
+		ids = append(ids, id)
+	}
+	fetchAll(ids, func(id int) {
+		tree := heroTreeMap[id]
+		tree.Icon = getIconFromHref(region, tree.MediaHref)
+		mutex.Lock()
+		heroTrees = append(heroTrees, tree)
+		mutex.Unlock()
+	})
+	logger.Printf("Found %d hero talent trees", len(heroTrees))
+	addHeroTrees(&heroTrees)
+}
+
 func getTalentTreePaths() []string {
 	paths := make(map[string]string)
 	type TalentTreeJSON struct {
@@ -226,10 +381,11 @@ func getTalentTreePaths() []string {
 		}
 	}
 
-	return getBestPaths(paths)
+	return getBestPaths(paths, talentTreeOverrides)
 }
 
-func getBestPaths(paths map[string]string) []string {
+// Latest version of each spec's tree, or the version pinned by overrides
+func getBestPaths(paths map[string]string, overrides map[int]int) []string {
 	sortedPaths := make([]string, 0, len(paths))
 	for k := range paths {
 		sortedPaths = append(sortedPaths, k)
@@ -237,27 +393,20 @@ func getBestPaths(paths map[string]string) []string {
 	sort.Strings(sortedPaths)
 
 	pathsBySpec := make(map[int]string)
+	versionsBySpec := make(map[int]int)
 	for _, path := range sortedPaths {
-		pathParts := strings.Split(path, "/")
-		spec, err := strconv.Atoi(pathParts[3])
+		spec, pathVersion, err := parseTalentTreeVersion(path)
 		if err != nil {
 			continue
 		}
-		pathVersion, _ := strconv.Atoi(pathParts[1])
-		if _, exists := pathsBySpec[spec]; exists {
-			existingParts := strings.Split(pathsBySpec[spec], "/")
-			existingVersion, _ := strconv.Atoi(existingParts[1])
-			if pathVersion > existingVersion {
-				pathsBySpec[spec] = path
-			}
-		} else {
+		if existingVersion, exists := versionsBySpec[spec]; !exists || pathVersion > existingVersion {
 			pathsBySpec[spec] = path
+			versionsBySpec[spec] = pathVersion
 		}
-
 	}
-	// Priest spec tree returned by Blizzard's API is
-	// bugged above v795 so we'll need to hardcode that
-	pathsBySpec[258] = "talent-tree/795/playable-specialization/258"
+	for spec, version := range overrides {
+		pathsBySpec[spec] = talentTreePath(spec, version)
+	}
 
 	bestPaths := make([]string, 0, len(pathsBySpec))
 	for _, path := range pathsBySpec {
@@ -282,7 +431,7 @@ func parseTalentTreePath(href string, regexpPattern string) string {
 	return string(match)
 }
 
-func getTalentsFromTree(path string) []talent {
+func getTalentsFromTree(path string) ([]talent, []heroTree, []talentNode) {
 	type TalentTreeJSON struct {
 		Class        keyedValue       `json:"playable_class"`
 		Spec         keyedValue       `json:"playable_specialization"`
@@ -295,13 +444,15 @@ func getTalentsFromTree(path string) []talent {
 	err := safeUnmarshal(talentTreeJSON, &talentTree)
 	if err != nil {
 		logger.Printf("%s parsing talents failed: %s", warnPrefix, err)
-		return []talent{}
+		return []talent{}, []heroTree{}, []talentNode{}
 	}
 
 	var talents []talent = make([]talent, 0)
+	var heroTrees []heroTree = make([]heroTree, 0)
 	if len(talentTree.SpecTalents) == 0 {
-		return talents
+		return talents, heroTrees, []talentNode{}
 	}
+	nodeLists := [][]TalentNodeJSON{talentTree.ClassTalents, talentTree.SpecTalents}
 
 	classTalents := parseTalents(talentTree.Class.ID, 0, "CLASS", []int{}, talentTree.ClassTalents)
 	talents = append(talents, classTalents...)
@@ -316,9 +467,44 @@ func getTalentsFromTree(path string) []talent {
 		}
 		heroTalents := parseTalents(talentTree.Class.ID, 0, "HERO", spec_ids, tree.HeroTalentNodes)
 		talents = append(talents, heroTalents...)
+		nodeLists = append(nodeLists, tree.HeroTalentNodes)
+		heroTrees = append(heroTrees, heroTree{
+			ID:        tree.ID,
+			Name:      tree.Name,
+			ClassID:   talentTree.Class.ID,
+			SpecIDs:   spec_ids,
+			MediaHref: tree.Media.Key.Href})
+	}
+
+	return talents, heroTrees, parseTalentNodes(talentTree.Class.ID, nodeLists...)
+}
+
+// Every node of a tree, including those without talents (which parseTalents skips)
+// and those only referenced by other nodes, as loadout strings encode each node of
+// the class's tree in order
+func parseTalentNodes(classID int, nodeLists ...[]TalentNodeJSON) []talentNode {
+	seen := make(map[int]bool)
+	for _, talentNodes := range nodeLists {
+		for _, node := range talentNodes {
+			seen[node.ID] = true
+			for _, id := range node.LockedBy {
+				seen[id] = true
+			}
+			for _, id := range node.Unlocks {
+				seen[id] = true
+			}
+		}
 	}
-
-	return talents
+	nodes := make([]talentNode, 0, len(seen))
+	for id := range seen {
+		if id > 0 {
+			nodes = append(nodes, talentNode{classID, id})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+	return nodes
 }
 
 func parseTalents(
@@ -331,11 +517,15 @@ func parseTalents(
 
 	for _, node := range talentNodes {
 		tooltips := extractTooltips(node.Ranks)
-		for _, tooltip := range tooltips {
+		isChoice := isChoiceNode(node.Ranks)
+		for choiceIndex, tooltip := range tooltips {
 			spellID := tooltip.SpellTooltip.Spell.ID
 			if spellID == 0 {
 				continue
 			}
+			if !isChoice {
+				choiceIndex = 0
+			}
 			talent := talent{
 				tooltip.Talent.ID,
 				spellID,
@@ -347,7 +537,10 @@ func parseTalents(
 				node.Row,
 				node.Col,
 				category,
-				heroSpecs}
+				heroSpecs,
+				len(node.Ranks),
+				isChoice,
+				choiceIndex}
 			talents = append(talents, talent)
 		}
 	}
@@ -355,6 +548,11 @@ func parseTalents(
 	return talents
 }
 
+// Choice nodes have a single rank offering a choice of talents
+func isChoiceNode(ranks []RankJSON) bool {
+	return len(ranks) > 0 && ranks[0].Tooltip.Talent.ID == 0 && len(ranks[0].Choice) > 0
+}
+
 func extractTooltips(ranks []RankJSON) []TooltipJSON {
 	var tooltips []TooltipJSON = make([]TooltipJSON, 0)
 	if len(ranks) == 0 {
@@ -400,56 +598,37 @@ func parsePvPTalents(data *[]byte) []pvpTalent {
 }
 
 func getPvPTalent(ch chan pvpTalent, id int) {
+	var pvpTalentJSON *[]byte = getStatic(region, fmt.Sprintf("pvp-talent/%d", id))
+	talent := parsePvPTalent(id, pvpTalentJSON)
+	talent.Icon = getIcon(region, fmt.Sprintf("spell/%d", talent.SpellID))
+	ch <- talent
+}
+
+func parsePvPTalent(id int, data *[]byte) pvpTalent {
 	type PvPTalentJSON struct {
 		Spell                  keyedValue
 		PlayableSpecialization keyedValue `json:"playable_specialization"`
+		Description            string
+		CompatibleSlots        []int      `json:"compatible_slots"`
+		UnlockPlayerLevel      int        `json:"unlock_player_level"`
+		OverridesSpell         keyedValue `json:"overrides_spell"`
 	}
-	var pvpTalentJSON *[]byte = getStatic(region, fmt.Sprintf("pvp-talent/%d", id))
 	var talentDetails PvPTalentJSON
-	safeUnmarshal(pvpTalentJSON, &talentDetails)
-	icon := getIcon(region, fmt.Sprintf("spell/%d", talentDetails.Spell.ID))
-	ch <- pvpTalent{
+	safeUnmarshal(data, &talentDetails)
+	compatibleSlots := talentDetails.CompatibleSlots
+	if compatibleSlots == nil {
+		compatibleSlots = []int{}
+	}
+	return pvpTalent{
 		id,
 		talentDetails.Spell.Name,
 		talentDetails.Spell.ID,
 		talentDetails.PlayableSpecialization.ID,
-		icon}
-}
-
-func parseAchievements(data *[]byte) []achievement {
-	type Achievements struct {
-		ID           int
-		Name         string
-		Achievements []keyedValue
-	}
-
-	var achievements Achievements
-	err := safeUnmarshal(data, &achievements)
-	var pvpAchievements []achievement = make([]achievement, 0)
-	if err != nil {
-		logger.Printf("%s parsing achievements failed: %s", warnPrefix, err)
-		return pvpAchievements
-	}
-
-	var achievementIDs []int = make([]int, 0)
-	for _, ac := range achievements.Achievements {
-		if strings.Contains(ac.Name, "Season") {
-			achievementIDs = append(achievementIDs, ac.ID)
-		}
-	}
-	var ch chan achievement = make(chan achievement, len(achievementIDs))
-	for _, id := range achievementIDs {
-		go getPvPAchievement(ch, id)
-	}
-	for range achievementIDs {
-		pvpAchievements = append(pvpAchievements, <-ch)
-	}
-
-	return pvpAchievements
-}
-
-func getPvPAchievement(ch chan achievement, id int) {
-	ch <- getAchievement(id)
+		"",
+		textureMarkup.ReplaceAllString(talentDetails.Description, ""),
+		compatibleSlots,
+		talentDetails.UnlockPlayerLevel,
+		talentDetails.OverridesSpell.ID}
 }
 
 func getAchievement(id int) achievement {
@@ -466,20 +645,83 @@ func getAchievement(id int) achievement {
 		id,
 		pvpAchievementJSONDetails.Name,
 		pvpAchievementJSONDetails.Description,
-		icon}
+		icon,
+		achievementTags{}}
 }
 
-func importAchievements() {
-	var achievementsJSON *[]byte = getStatic(region, fmt.Sprintf("achievement-category/%d", pvpFeatsOfStrengthCategory))
-	var achievements []achievement = parseAchievements(achievementsJSON)
-	var seasonalCount int = len(achievements)
-	logger.Printf("Found %d seasonal achievements", seasonalCount)
-	for _, id := range achievementIDs {
-		achievement := getAchievement(id)
-		achievements = append(achievements, achievement)
+// Queue items not yet considered this run for a details refresh
+func queueItemDetails(equippedItems map[int]item) {
+	queuedItemsLock.Lock()
+	defer queuedItemsLock.Unlock()
+	for id := range equippedItems {
+		if _, checked := checkedItems.LoadOrStore(id, true); !checked {
+			queuedItems = append(queuedItems, id)
+		}
+	}
+}
+
+// Retrieve details and icons of queued items that have never had them or
+// whose details are older than the TTL
+func importItemDetails() {
+	queuedItemsLock.Lock()
+	ids := queuedItems
+	queuedItems = nil
+	queuedItemsLock.Unlock()
+	ids = getItemIDsNeedingDetails(ids, itemDetailsTTLHours)
+	if len(ids) == 0 {
+		return
+	}
+
+	details := make([]itemDetails, 0)
+	var mutex sync.Mutex
+	fetchAll(ids, func(id int) {
+		d := getItemDetails(id)
+		if d.ID == 0 {
+			return
+		}
+		mutex.Lock()
+		details = append(details, d)
+		mutex.Unlock()
+	})
+	logger.Printf("Found details for %d of %d items", len(details), len(ids))
+	addItemDetails(&details)
+}
+
+func getItemDetails(id int) itemDetails {
+	var itemJSON *[]byte = getStatic(region, fmt.Sprintf("item/%d", id))
+	if itemJSON == nil {
+		return itemDetails{}
+	}
+	details := parseItemDetails(itemJSON)
+	if details.ID == 0 {
+		return details
+	}
+	details.Icon = getIcon(region, fmt.Sprintf("item/%d", id))
+	return details
+}
+
+// Details (without the icon, which comes from the media endpoint) of an item
+func parseItemDetails(data *[]byte) itemDetails {
+	type ItemJSON struct {
+		ID            int
+		RequiredLevel int        `json:"required_level"`
+		ItemClass     keyedValue `json:"item_class"`
+		ItemSubclass  keyedValue `json:"item_subclass"`
+		InventoryType typedName  `json:"inventory_type"`
+	}
+	var i ItemJSON
+	err := safeUnmarshal(data, &i)
+	if err != nil {
+		logger.Printf("%s parsing item failed: %s", warnPrefix, err)
+		return itemDetails{}
 	}
-	logger.Printf("Found %d non-seasonal achievements", len(achievements)-seasonalCount)
-	addAchievements(&achievements)
+	return itemDetails{
+		i.ID,
+		"",
+		i.ItemClass.ID,
+		i.ItemSubclass.ID,
+		i.InventoryType.Type,
+		i.RequiredLevel}
 }
 
 type SpellTooltipJSON struct {
@@ -495,13 +737,17 @@ type RankJSON struct {
 	Choice  []TooltipJSON `json:"choice_of_tooltips"`
 }
 type TalentNodeJSON struct {
-	ID    int
-	Row   int `json:"display_row"`
-	Col   int `json:"display_col"`
-	Ranks []RankJSON
+	ID       int
+	Row      int `json:"display_row"`
+	Col      int `json:"display_col"`
+	Ranks    []RankJSON
+	LockedBy []int `json:"locked_by"`
+	Unlocks  []int
 }
 type HeroTreeJSON struct {
 	ID              int
+	Name            string
+	Media           keyedValue
 	HeroTalentNodes []TalentNodeJSON `json:"hero_talent_nodes"`
 	Specs           []keyedValue     `json:"playable_specializations"`
 }
@@ -12,9 +12,14 @@ type query struct {
 
 // realm : realm info
 type realm struct {
-	ID   int
-	Slug string
-	Name string
+	ID               int
+	Slug             string
+	Name             string
+	ConnectedRealmID int
+	Type             string
+	Timezone         string
+	Locale           string
+	Category         string
 }
 
 // race : playable race
@@ -31,35 +36,83 @@ type class struct {
 
 // spec : class specialization
 type spec struct {
-	ID      int
-	ClassID int
-	Name    string
-	Role    string
-	Icon    string
+	ID                int
+	ClassID           int
+	Name              string
+	Role              string
+	Icon              string
+	Slug              string
+	PrimaryStat       string
+	MaleDescription   string
+	FemaleDescription string
+	TalentTreeID      int
+	PvPTalentIDs      []int
 }
 
 // talent : talent info
 type talent struct {
+	ID          int
+	SpellID     int
+	ClassID     int
+	SpecID      int
+	Name        string
+	Icon        string
+	NodeID      int
+	Row         int
+	Col         int
+	Cat         string
+	HeroSpecs   []int
+	MaxRank     int
+	ChoiceNode  bool
+	ChoiceIndex int
+}
+
+// talentNode : a node of a class's talent tree, with or without talents
+type talentNode struct {
+	ClassID int
+	NodeID  int
+}
+
+// selectedTalent : talent selected by a player and the rank they chose
+type selectedTalent struct {
+	ID     int
+	NodeID int
+	Rank   int
+}
+
+// playerLoadout : a player's talent loadout string
+type playerLoadout struct {
+	Code  string
+	Valid bool
+}
+
+// heroTree : hero talent tree info
+type heroTree struct {
 	ID        int
-	SpellID   int
-	ClassID   int
-	SpecID    int
 	Name      string
+	ClassID   int
 	Icon      string
-	NodeID    int
-	Row       int
-	Col       int
-	Cat       string
-	HeroSpecs []int
+	SpecIDs   []int
+	MediaHref string
 }
 
 // pvpTalent : PvP talent info
 type pvpTalent struct {
-	ID      int
-	Name    string
-	SpellID int
-	SpecID  int
-	Icon    string
+	ID                int
+	Name              string
+	SpellID           int
+	SpecID            int
+	Icon              string
+	Description       string
+	CompatibleSlots   []int
+	UnlockPlayerLevel int
+	OverridesSpellID  int
+}
+
+// selectedPvPTalent : a PvP talent selected by a player and the slot it's in
+type selectedPvPTalent struct {
+	ID   int
+	Slot int
 }
 
 // achievement : completed achievement info
@@ -68,6 +121,15 @@ type achievement struct {
 	Title       string
 	Description string
 	Icon        string
+	Tags        achievementTags
+}
+
+// localization : translated name (and description) of a static entity
+type localization struct {
+	ID          int
+	Locale      string
+	Name        string
+	Description string
 }
 
 // stats : player stat info
@@ -110,6 +172,54 @@ type player struct {
 	Path       string
 	LastLogin  int64
 	ProfileID  string
+	// Blizzard's IDs for the guild and its realm
+	GuildID        int
+	GuildRealmID   int
+	GuildFactionID int
+}
+
+// playerResult : everything retrieved from the API for a player
+type playerResult struct {
+	Player       *player
+	Stale        bool
+	Talents      playerTalents
+	Stats        stats
+	Achievements []playerAchievement
+	Accolades    []accolade
+	Items        items
+	Media        *playerMedia
+	Failure      *fetchFailure
+}
+
+// playerAchievement : a completed achievement and when (epoch millis) it was completed
+type playerAchievement struct {
+	ID          int
+	CompletedAt int64
+}
+
+// accolade : a PvP achievement, title or mount and when (epoch millis, 0 if unknown) it was earned
+type accolade struct {
+	Kind       string
+	ID         int
+	Name       string
+	AchievedAt int64
+}
+
+// pvpSeason : start and end (epoch millis, 0 if ongoing) of a PvP season
+type pvpSeason struct {
+	ID    int
+	Start int64
+	End   int64
+}
+
+// playerMedia : character render URLs and what they were rendered with
+type playerMedia struct {
+	Avatar    string
+	Inset     string
+	MainRaw   string
+	RaceID    int
+	GearHash  string
+	FetchedAt int64
 }
 
 // item : an equippable item
@@ -119,6 +229,16 @@ type item struct {
 	Quality string
 }
 
+// itemDetails : static info about an item
+type itemDetails struct {
+	ID            int
+	Icon          string
+	ClassID       int
+	SubclassID    int
+	InventoryType string
+	RequiredLevel int
+}
+
 // items : a player's equipped items
 type items struct {
 	Head      item
@@ -140,4 +260,28 @@ type items struct {
 	MainHand  item
 	OffHand   item
 	Legendary item
+	Equipment []equippedItem
+}
+
+// equippedItem : an item equipped in a slot including its customizations
+type equippedItem struct {
+	Slot          string
+	ItemID        int
+	InventoryType string
+	Level         int
+	EnchantIDs    []int
+	EnchantNames  []string
+	GemIDs        []int
+	BonusIDs      []int
+	CraftedStats  []string
+	SetID         int
+	Embellished   bool
+}
+
+// talentTreeVersion : a version of a spec's talent tree and its (sorted) node IDs
+type talentTreeVersion struct {
+	SpecID  int
+	Version int
+	NodeIDs []int
+	Flagged bool
 }
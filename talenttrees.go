@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Tracking of talent tree versions so broken trees returned by the API can be spotted */
+
+// The shadow priest tree returned by Blizzard's API is bugged above v795
+const defaultTalentTreeOverrides string = "258=795"
+
+// Pinned tree versions by spec, from TALENT_TREE_OVERRIDES_FILE (a JSON object
+// of spec ID => version) overlaid with TALENT_TREE_OVERRIDES ("258=795,...")
+var talentTreeOverrides map[int]int = loadTalentTreeOverrides(
+	os.Getenv("TALENT_TREE_OVERRIDES_FILE"),
+	getEnvVarStringOrDefault("TALENT_TREE_OVERRIDES", defaultTalentTreeOverrides))
+
+// A tree is flagged if it loses more than this percentage of the
+// prior version's nodes or shares fewer than this percentage of them
+var talentTreeMaxNodeDropPercent int = getEnvVarOrDefault("TALENT_TREE_MAX_NODE_DROP_PERCENT", 10)
+var talentTreeMinNodeOverlapPercent int = getEnvVarOrDefault("TALENT_TREE_MIN_NODE_OVERLAP_PERCENT", 50)
+
+func loadTalentTreeOverrides(file string, overrides string) map[int]int {
+	m := make(map[int]int)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			logger.Printf("%s reading talent tree overrides failed: %s", warnPrefix, err)
+		} else {
+			var fromFile map[string]int
+			err = json.Unmarshal(data, &fromFile)
+			if err != nil {
+				logger.Printf("%s parsing talent tree overrides failed: %s", warnPrefix, err)
+			}
+			for spec, version := range fromFile {
+				specID, err := strconv.Atoi(spec)
+				if err != nil {
+					logger.Printf("%s Invalid talent tree override spec '%s'", warnPrefix, spec)
+					continue
+				}
+				m[specID] = version
+			}
+		}
+	}
+	for specID, version := range parseTalentTreeOverrides(overrides) {
+		m[specID] = version
+	}
+	return m
+}
+
+// Parses pinned versions in the form "258=795,62=800" skipping invalid entries
+func parseTalentTreeOverrides(overrides string) map[int]int {
+	m := make(map[int]int)
+	for _, pair := range strings.Split(overrides, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), "=")
+		if len(parts) != 2 {
+			continue
+		}
+		specID, specErr := strconv.Atoi(parts[0])
+		version, versionErr := strconv.Atoi(parts[1])
+		if specErr != nil || versionErr != nil {
+			logger.Printf("%s Invalid talent tree override '%s'", warnPrefix, pair)
+			continue
+		}
+		m[specID] = version
+	}
+	return m
+}
+
+func talentTreePath(specID int, version int) string {
+	return fmt.Sprintf("talent-tree/%d/playable-specialization/%d", version, specID)
+}
+
+// Spec ID and version of a path in the form talent-tree/{version}/playable-specialization/{spec}
+func parseTalentTreeVersion(path string) (int, int, error) {
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) < 4 {
+		return 0, 0, fmt.Errorf("invalid talent tree path '%s'", path)
+	}
+	spec, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		return 0, 0, err
+	}
+	version, err := strconv.Atoi(pathParts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return spec, version, nil
+}
+
+// Sorted (distinct) nodes of a tree's talents
+func talentTreeNodeIDs(talents []talent) []int {
+	seen := make(map[int]bool)
+	nodeIDs := make([]int, 0)
+	for _, t := range talents {
+		if !seen[t.NodeID] {
+			seen[t.NodeID] = true
+			nodeIDs = append(nodeIDs, t.NodeID)
+		}
+	}
+	sort.Ints(nodeIDs)
+	return nodeIDs
+}
+
+// Whether a tree's layout looks broken compared to the prior version of the spec's tree
+func isBrokenTalentTree(tree talentTreeVersion, prior talentTreeVersion) bool {
+	if len(tree.NodeIDs) == 0 {
+		return true
+	}
+	if len(prior.NodeIDs) == 0 {
+		return false
+	}
+	if len(tree.NodeIDs)*100 < len(prior.NodeIDs)*(100-talentTreeMaxNodeDropPercent) {
+		return true
+	}
+	nodes := make(map[int]bool, len(tree.NodeIDs))
+	for _, id := range tree.NodeIDs {
+		nodes[id] = true
+	}
+	overlap := 0
+	for _, id := range prior.NodeIDs {
+		if nodes[id] {
+			overlap++
+		}
+	}
+	return overlap*100 < len(prior.NodeIDs)*talentTreeMinNodeOverlapPercent
+}
+
+// Talents of the tree at path, unless its layout looks broken compared to the
+// last good version of the spec's tree in which case that version's are used.
+// Pinned versions are recorded but never replaced.
+func getValidatedTalents(path string, lastGood map[int]talentTreeVersion) ([]talent, []heroTree, []talentNode) {
+	talents, heroTrees, nodes := getTalentsFromTree(path)
+	specID, version, err := parseTalentTreeVersion(path)
+	if err != nil {
+		logger.Printf("%s %s", warnPrefix, err)
+		return talents, heroTrees, nodes
+	}
+
+	tree := talentTreeVersion{specID, version, talentTreeNodeIDs(talents), false}
+	prior, hasPrior := lastGood[specID]
+	_, pinned := talentTreeOverrides[specID]
+	if hasPrior && prior.Version >= version {
+		return talents, heroTrees, nodes
+	}
+	tree.Flagged = isBrokenTalentTree(tree, prior)
+	// An empty tree is more likely a failed request than a new version
+	if len(tree.NodeIDs) > 0 {
+		addTalentTreeVersion(tree)
+	}
+	if !tree.Flagged || pinned {
+		return talents, heroTrees, nodes
+	}
+
+	if !hasPrior {
+		logger.Printf("%s Talent tree %s looks broken with no prior version to use", warnPrefix, path)
+		return talents, heroTrees, nodes
+	}
+	logger.Printf("%s Talent tree %s looks broken (%d nodes vs %d), using v%d instead", warnPrefix,
+		path, len(tree.NodeIDs), len(prior.NodeIDs), prior.Version)
+	return getTalentsFromTree(talentTreePath(specID, prior.Version))
+}
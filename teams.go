@@ -0,0 +1,250 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+/* Inference of arena teams from players whose records changed together between runs */
+
+var teamSizes = map[string]int{"2v2": 2, "3v3": 3}
+
+// Players must have played at least this many games since the prior snapshot and
+// their wins and losses deltas may differ by at most the tolerance (combined)
+var teamMinGames int = getEnvVarOrDefault("TEAM_MIN_GAMES", 5)
+var teamDeltaTolerance int = getEnvVarOrDefault("TEAM_DELTA_TOLERANCE", 1)
+var teamMinConfidence float64 = float64(getEnvVarOrDefault("TEAM_MIN_CONFIDENCE_PERCENT", 50)) / 100
+
+// Teammates play at the same time so their last logins must be within this window
+var teamLoginWindowSeconds int64 = int64(getEnvVarOrDefault("TEAM_LOGIN_WINDOW_HOURS", 12)) * 60 * 60
+
+// Teams whose members all share a realm are more likely to be genuine
+const sameRealmBonus float64 = 0.1
+
+// Players with more candidate partners than this are too ambiguous to place in a team
+const teamMaxCandidates int = 20
+
+// snapshotEntry : a player's season record when leaderboards were last stored
+// and their last login (as of this run's import, 0 if unknown)
+type snapshotEntry struct {
+	Wins      int
+	Losses    int
+	LastLogin int64
+}
+
+// inferredTeam : players (keys) likely to be queueing together
+type inferredTeam struct {
+	Members    []string
+	Wins       int
+	Losses     int
+	Rating     int
+	Confidence float64
+}
+
+type activePlayer struct {
+	Key       string
+	RealmID   int
+	Wins      int
+	Losses    int
+	Rating    int
+	LastLogin int64
+}
+
+func deltaDistance(a activePlayer, b activePlayer) int {
+	return absInt(a.Wins-b.Wins) + absInt(a.Losses-b.Losses)
+}
+
+// Whether two players were active at around the same time, unknown logins can't rule it out
+func overlappingActivity(a activePlayer, b activePlayer) bool {
+	if a.LastLogin == 0 || b.LastLogin == 0 {
+		return true
+	}
+	return absInt64(a.LastLogin-b.LastLogin) <= teamLoginWindowSeconds
+}
+
+func absInt64(i int64) int64 {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func absInt(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// How alike two players' deltas are, 1 being identical
+func deltaSimilarity(a activePlayer, b activePlayer) float64 {
+	games := max(a.Wins+a.Losses, b.Wins+b.Losses)
+	return math.Max(0, 1-float64(deltaDistance(a, b))/float64(games))
+}
+
+// Group the entries of a bracket into teams of size players by matching the changes in
+// their wins and losses since the previous snapshot, only matching players whose
+// last logins are close enough for them to have been playing together. Confidence is the members' average
+// similarity reduced when members had more candidate partners than a team can hold.
+func inferTeams(entries []leaderboardEntry, previous map[string]snapshotEntry, size int) []inferredTeam {
+	active := make([]activePlayer, 0)
+	for _, entry := range entries {
+		key := playerKey(entry.RealmID, entry.BlizzardID)
+		prior, exists := previous[key]
+		if !exists {
+			continue
+		}
+		wins := entry.SeasonWins - prior.Wins
+		losses := entry.SeasonLosses - prior.Losses
+		if wins < 0 || losses < 0 || wins+losses < teamMinGames {
+			continue
+		}
+		active = append(active, activePlayer{key, entry.RealmID, wins, losses, entry.Rating, prior.LastLogin})
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].Wins == active[j].Wins {
+			if active[i].Losses == active[j].Losses {
+				return active[i].Key < active[j].Key
+			}
+			return active[i].Losses < active[j].Losses
+		}
+		return active[i].Wins < active[j].Wins
+	})
+
+	// Sorted by wins so candidates are found within a window
+	candidates := make([][]int, len(active))
+	for i := range active {
+		for j := i + 1; j < len(active) && active[j].Wins-active[i].Wins <= teamDeltaTolerance; j++ {
+			if deltaDistance(active[i], active[j]) <= teamDeltaTolerance && overlappingActivity(active[i], active[j]) {
+				candidates[i] = append(candidates[i], j)
+				candidates[j] = append(candidates[j], i)
+			}
+		}
+	}
+
+	type scoredTeam struct {
+		members    []int
+		confidence float64
+	}
+	possible := make([]scoredTeam, 0)
+	for i := range active {
+		if len(candidates[i]) > teamMaxCandidates {
+			continue
+		}
+		for _, members := range teamsWith(i, candidates, size) {
+			possible = append(possible, scoredTeam{members, teamConfidence(members, active, candidates, size)})
+		}
+	}
+	sort.SliceStable(possible, func(i, j int) bool {
+		return possible[i].confidence > possible[j].confidence
+	})
+
+	teams := make([]inferredTeam, 0)
+	assigned := make(map[int]bool)
+	for _, p := range possible {
+		if p.confidence < teamMinConfidence {
+			break
+		}
+		available := true
+		for _, m := range p.members {
+			available = available && !assigned[m]
+		}
+		if !available {
+			continue
+		}
+		team := inferredTeam{Confidence: p.confidence}
+		rating := 0
+		for _, m := range p.members {
+			assigned[m] = true
+			team.Members = append(team.Members, active[m].Key)
+			team.Wins += active[m].Wins
+			team.Losses += active[m].Losses
+			rating += active[m].Rating
+		}
+		team.Wins /= size
+		team.Losses /= size
+		team.Rating = rating / size
+		teams = append(teams, team)
+	}
+	return teams
+}
+
+// Every team of size players (ascending indexes) including i in which all members are each other's candidates
+func teamsWith(i int, candidates [][]int, size int) [][]int {
+	teams := make([][]int, 0)
+	var extend func(members []int)
+	extend = func(members []int) {
+		if len(members) == size {
+			teams = append(teams, append([]int{}, members...))
+			return
+		}
+		last := members[len(members)-1]
+		for _, c := range candidates[last] {
+			if c <= last || len(candidates[c]) > teamMaxCandidates {
+				continue
+			}
+			allCandidates := true
+			for _, m := range members {
+				allCandidates = allCandidates && isCandidate(candidates[m], c)
+			}
+			if allCandidates {
+				extend(append(members, c))
+			}
+		}
+	}
+	extend([]int{i})
+	return teams
+}
+
+func isCandidate(candidates []int, c int) bool {
+	for _, candidate := range candidates {
+		if candidate == c {
+			return true
+		}
+	}
+	return false
+}
+
+func teamConfidence(members []int, active []activePlayer, candidates [][]int, size int) float64 {
+	similarity := 0.0
+	pairs := 0
+	sameRealm := true
+	for x := 0; x < len(members); x++ {
+		for y := x + 1; y < len(members); y++ {
+			similarity += deltaSimilarity(active[members[x]], active[members[y]])
+			pairs++
+			sameRealm = sameRealm && active[members[x]].RealmID == active[members[y]].RealmID
+		}
+	}
+	similarity /= float64(pairs)
+
+	uniqueness := 0.0
+	for _, m := range members {
+		uniqueness += float64(size-1) / float64(max(size-1, len(candidates[m])))
+	}
+	uniqueness /= float64(len(members))
+
+	confidence := similarity * uniqueness
+	if sameRealm {
+		confidence += sameRealmBonus
+	}
+	return math.Min(1, confidence)
+}
+
+// Infer teams for the region's arena brackets using the leaderboards stored by the previous run,
+// skipping blocked brackets as their leaderboards won't be stored
+func updateInferredTeams(leaderboards map[string][]leaderboardEntry, blocked map[string]bool) {
+	for bracket, size := range teamSizes {
+		leaderboard, exists := leaderboards[bracket]
+		if !exists || len(leaderboard) == 0 || blocked[bracket] {
+			continue
+		}
+		teams := inferTeams(leaderboard, getLeaderboardSnapshot(bracket), size)
+		logger.Printf("Inferred %d %s %s teams", len(teams), region, bracket)
+		// Nothing changed since the snapshot (e.g. a resumed run) so keep the prior teams
+		if len(teams) == 0 {
+			continue
+		}
+		addInferredTeams(bracket, teams, getPlayerIDsFromLeaderboard(leaderboard))
+	}
+}
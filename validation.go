@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+/* Checks of each region's data before it replaces the published leaderboards */
+
+// Modes: "block" skips updating leaderboards (and aggregates) that fail validation,
+// "degrade" updates them but records the run as degraded and "off" skips validation
+var validationMode string = strings.ToLower(getEnvVarStringOrDefault("VALIDATION_MODE", "degrade"))
+
+var maxLeaderboardDropPercent int = getEnvVarOrDefault("VALIDATION_MAX_LEADERBOARD_DROP_PERCENT", 50)
+var maxProfileFailurePercent int = getEnvVarOrDefault("VALIDATION_MAX_PROFILE_FAILURE_PERCENT", 20)
+var maxZeroStatsPercent int = getEnvVarOrDefault("VALIDATION_MAX_ZERO_STATS_PERCENT", 10)
+var minAverageTalents int = getEnvVarOrDefault("VALIDATION_MIN_AVERAGE_TALENTS", 20)
+
+// Validation outcomes
+const (
+	validationPassed   string = "passed"
+	validationDegraded string = "degraded"
+	validationBlocked  string = "blocked"
+)
+
+// runMetrics : counts of the players imported for the current region
+type runMetrics struct {
+	Players          int
+	ProfileFailures  int
+	PlayersImported  int
+	Talents          int
+	ZeroStatsPlayers int
+}
+
+// validationCheck : a measurement of the run's data and the limit it must be within
+type validationCheck struct {
+	Name    string
+	Bracket string
+	Value   float64
+	Limit   float64
+	Passed  bool
+}
+
+var metrics runMetrics
+var metricsLock sync.Mutex
+
+func resetRunMetrics() {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metrics = runMetrics{}
+}
+
+func getRunMetrics() runMetrics {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	return metrics
+}
+
+// Count the outcome of each player in a batch of results (stale players are ignored)
+func recordRunMetrics(results []playerResult) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	for _, result := range results {
+		if result.Stale {
+			continue
+		}
+		metrics.Players++
+		if result.Player.ClassID == 0 {
+			metrics.ProfileFailures++
+			continue
+		}
+		if len(result.Talents.Talents) == 0 {
+			continue
+		}
+		metrics.PlayersImported++
+		metrics.Talents += len(result.Talents.Talents)
+		s := result.Stats
+		if isIncompleteStats([]float64{float64(s.CriticalStrike), float64(s.Haste), float64(s.Mastery),
+			float64(s.Versatility), float64(s.Leech)}) {
+			metrics.ZeroStatsPlayers++
+		}
+	}
+}
+
+func percentage(part int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+// Compare the region's leaderboards against the sizes of the stored ones, and
+// the players imported against the thresholds. Brackets not previously stored
+// and metrics without any players aren't checked.
+func validateRun(leaderboards map[string][]leaderboardEntry, previousSizes map[string]int, m runMetrics) []validationCheck {
+	checks := make([]validationCheck, 0)
+	for bracket, leaderboard := range leaderboards {
+		previous := previousSizes[bracket]
+		if previous == 0 {
+			continue
+		}
+		drop := 100 - percentage(len(leaderboard), previous)
+		checks = append(checks, validationCheck{"leaderboard_drop_percent", bracket,
+			drop, float64(maxLeaderboardDropPercent), drop <= float64(maxLeaderboardDropPercent)})
+	}
+
+	if m.Players > 0 {
+		failures := percentage(m.ProfileFailures, m.Players)
+		checks = append(checks, validationCheck{"profile_failure_percent", "",
+			failures, float64(maxProfileFailurePercent), failures <= float64(maxProfileFailurePercent)})
+	}
+	if m.PlayersImported > 0 {
+		averageTalents := float64(m.Talents) / float64(m.PlayersImported)
+		checks = append(checks, validationCheck{"average_talents", "",
+			averageTalents, float64(minAverageTalents), averageTalents >= float64(minAverageTalents)})
+		zeroStats := percentage(m.ZeroStatsPlayers, m.PlayersImported)
+		checks = append(checks, validationCheck{"zero_stats_percent", "",
+			zeroStats, float64(maxZeroStatsPercent), zeroStats <= float64(maxZeroStatsPercent)})
+	}
+	return checks
+}
+
+// Brackets whose leaderboards shouldn't be updated: every bracket if a check of
+// the players failed, otherwise only those whose own checks failed
+func blockedBrackets(leaderboards map[string][]leaderboardEntry, checks []validationCheck) map[string]bool {
+	blocked := make(map[string]bool)
+	for _, check := range checks {
+		if check.Passed {
+			continue
+		}
+		if check.Bracket != "" {
+			blocked[check.Bracket] = true
+			continue
+		}
+		for bracket := range leaderboards {
+			blocked[bracket] = true
+		}
+	}
+	return blocked
+}
+
+// Validate the region's data, returning the brackets (if any) that must not be updated
+func validateRegion(leaderboards map[string][]leaderboardEntry) map[string]bool {
+	if validationMode == "off" {
+		return map[string]bool{}
+	}
+	checks := validateRun(leaderboards, getLeaderboardSizes(), getRunMetrics())
+	outcome := validationPassed
+	for _, check := range checks {
+		if check.Passed {
+			continue
+		}
+		logger.Printf("%s %s validation '%s' %s failed: %.2f (limit %.2f)", warnPrefix, region,
+			check.Name, check.Bracket, check.Value, check.Limit)
+		outcome = validationDegraded
+		if validationMode == "block" {
+			outcome = validationBlocked
+		}
+	}
+	addRunValidation(checks, outcome)
+
+	if outcome != validationBlocked {
+		return map[string]bool{}
+	}
+	return blockedBrackets(leaderboards, checks)
+}
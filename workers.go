@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map/v2"
+)
+
+// HTTP fetch workers spend nearly all their time waiting on the API while DB
+// writers each hold a connection, so the two pools are sized independently
+var fetchWorkers int = max(getEnvVarOrDefault("FETCH_WORKERS", 20), 1)
+var dbWriters int = max(getEnvVarOrDefault("DB_WRITERS",
+	getEnvVarOrDefault("MAX_DB_CONNECTIONS", defaultMaxDbConnections)/2), 1)
+var dbBatchSize int = max(getEnvVarOrDefault("DB_BATCH_SIZE", 250), 1)
+var dbBatchInterval time.Duration = time.Duration(
+	max(getEnvVarOrDefault("DB_BATCH_INTERVAL_SECONDS", 30), 1)) * time.Second
+
+// Import players by feeding them through a pool of fetch workers whose
+// results are grouped into batches for a (separate) pool of DB writers
+func importPlayers(players []*player) {
+	logger.Printf("Importing %d players with %d fetch workers and %d DB writers",
+		len(players), fetchWorkers, dbWriters)
+	pvpAchievements := getAchievementIds()
+	previousMedia := getPlayersMedia()
+
+	jobs := make(chan *player, fetchWorkers)
+	results := make(chan playerResult, dbBatchSize)
+	batches := make(chan []playerResult, dbWriters)
+
+	var fetchGroup sync.WaitGroup
+	fetchGroup.Add(fetchWorkers)
+	for i := 0; i < fetchWorkers; i++ {
+		go func() {
+			defer fetchGroup.Done()
+			for player := range jobs {
+				results <- fetchPlayer(player, pvpAchievements, previousMedia)
+			}
+		}()
+	}
+
+	var writeGroup sync.WaitGroup
+	writeGroup.Add(dbWriters)
+	for i := 0; i < dbWriters; i++ {
+		go func() {
+			defer writeGroup.Done()
+			for batch := range batches {
+				writePlayers(batch)
+			}
+		}()
+	}
+
+	go func() {
+		for _, player := range players {
+			jobs <- player
+		}
+		close(jobs)
+	}()
+	go func() {
+		fetchGroup.Wait()
+		close(results)
+	}()
+
+	batchResults(results, batches, dbBatchSize, dbBatchInterval)
+	writeGroup.Wait()
+	// Fetched once the writers finish so they never wait on the API
+	importItemDetails()
+}
+
+// Call fetch for each of the IDs using up to fetchWorkers goroutines
+func fetchAll(ids []int, fetch func(id int)) {
+	jobs := make(chan int, len(ids))
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(fetchWorkers)
+	for i := 0; i < fetchWorkers; i++ {
+		go func() {
+			defer waitGroup.Done()
+			for id := range jobs {
+				fetch(id)
+			}
+		}()
+	}
+	waitGroup.Wait()
+}
+
+// Group results into batches, sending a batch once it is full or the interval
+// elapses (whichever comes first). Closes batches once results is drained.
+func batchResults(results <-chan playerResult, batches chan<- []playerResult, size int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(batches)
+
+	batch := make([]playerResult, 0, size)
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				if len(batch) > 0 {
+					batches <- batch
+				}
+				return
+			}
+			batch = append(batch, result)
+			if len(batch) >= size {
+				batches <- batch
+				batch = make([]playerResult, 0, size)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				batches <- batch
+				batch = make([]playerResult, 0, size)
+			}
+		}
+	}
+}
+
+// Retrieve everything needed for a player from the API, skipping
+// the details if the player couldn't be found or is stale
+func fetchPlayer(player *player, pvpAchievements map[int]bool, previousMedia map[string]playerMedia) playerResult {
+	failure := setPlayerDetails(player)
+	result := playerResult{Player: player, Failure: failure}
+	if player.ClassID == 0 {
+		return result
+	}
+	if (time.Now().Unix() - player.LastLogin) > loginStaleSeconds {
+		result.Stale = true
+		return result
+	}
+
+	talents, status := getPlayerTalents(player.Path)
+	result.Talents = talents
+	// If we couldn't get the player's talents don't bother attempting other data,
+	// though a player without any talents is only a failure if the request failed
+	if len(result.Talents.Talents) == 0 {
+		if status != http.StatusOK {
+			result.Failure = &fetchFailure{"talents", status}
+		}
+		return result
+	}
+	result.Stats = getPlayerStats(player.Path)
+	result.Achievements = getPlayerAchievements(player.Path, pvpAchievements)
+	result.Accolades = getPlayerAccolades(player.Path, result.Achievements, pvpAchievements)
+	result.Items = getPlayerItems(player.Path)
+	result.Media = getPlayerMedia(player, result.Items.Equipment, previousMedia)
+
+	return result
+}
+
+func writePlayers(results []playerResult) {
+	results = deferTransientFailures(results)
+	recordRunMetrics(results)
+	recordFetchFailures(results)
+	foundPlayers := make([]*player, 0)
+	// Only players fully imported (or found stale) are checkpointed so those
+	// that couldn't be retrieved are attempted again if the run is resumed
+	importedPlayers := make([]*player, 0, len(results))
+	failures := make(map[*player]fetchFailure)
+	stalePlayers := 0
+	for _, result := range results {
+		if result.Failure != nil {
+			failures[result.Player] = *result.Failure
+		}
+		if result.Player.ClassID == 0 {
+			continue
+		}
+		if result.Stale {
+			stalePlayers++
+			importedPlayers = append(importedPlayers, result.Player)
+			continue
+		}
+		foundPlayers = append(foundPlayers, result.Player)
+		if len(result.Talents.Talents) > 0 {
+			importedPlayers = append(importedPlayers, result.Player)
+		}
+	}
+
+	logger.Printf("Found %d of %d players, including %d stale players",
+		(len(foundPlayers) + stalePlayers), len(results), stalePlayers)
+	addFetchFailures(failures)
+	clearFetchFailures(importedPlayers)
+	addGuilds(foundPlayers)
+	addPlayers(foundPlayers)
+	var playerIDs map[string]int = getPlayerIDs(foundPlayers)
+
+	var playersTalents map[int]playerTalents = make(map[int]playerTalents, 0)
+	var playersStats map[int]stats = make(map[int]stats, 0)
+	var playersAchievements map[int][]playerAchievement = make(map[int][]playerAchievement, 0)
+	var playersAccolades map[int][]accolade = make(map[int][]accolade, 0)
+	var playersLoadouts map[int]playerLoadout = make(map[int]playerLoadout, 0)
+	var playersMedia map[int]playerMedia = make(map[int]playerMedia, 0)
+	playersItems := cmap.New[items]()
+	for _, result := range results {
+		dbID, exists := playerIDs[result.Player.Path]
+		if !exists || len(result.Talents.Talents) == 0 {
+			continue
+		}
+		playersTalents[dbID] = result.Talents
+		playersStats[dbID] = result.Stats
+		playersAchievements[dbID] = result.Achievements
+		playersAccolades[dbID] = result.Accolades
+		playersItems.SetIfAbsent(strconv.Itoa(dbID), result.Items)
+		if result.Media != nil {
+			playersMedia[dbID] = *result.Media
+		}
+		if code := result.Talents.LoadoutCode; code != "" {
+			valid := validateLoadout(code, result.Player.ClassID, result.Talents.Talents)
+			playersLoadouts[dbID] = playerLoadout{code, valid}
+		}
+	}
+	addPlayerTalents(playersTalents)
+	addPlayerHeroTrees(playersTalents)
+	addPlayerLoadouts(playersLoadouts)
+	addPlayerStats(playersStats)
+	addPlayerAchievements(playersAchievements)
+	addPlayerAccolades(playersAccolades)
+	squashedItems := squashItems(&playersItems)
+	addItems(squashedItems)
+	queueItemDetails(squashedItems)
+	addPlayerItems(&playersItems)
+	addPlayerEquipment(&playersItems)
+	addPlayerMedia(playersMedia)
+
+	addImportCheckpoints(importedPlayers)
+}